@@ -18,15 +18,35 @@ func app_main() {
 	switch *common.C.Type {
 	case "server":
 		go http.ListenAndServe(common.G.Server.DebugBindAddress, nil)
-		http.ListenAndServe(
-			common.G.Server.BindAddress,
-			proxy.NewProxyServer())
+		ps := proxy.NewProxyServer()
+		if ps == nil {
+			fmt.Fprintf(os.Stderr, "NewProxyServer fail\n")
+			os.Exit(-1)
+		}
+		common.HandleReload(ps.Reload)
+		var err error
+		tls_config := ps.TLSConfig()
+		server := &http.Server{
+			Addr:      common.G.Server.BindAddress,
+			Handler:   ps,
+			TLSConfig: tls_config,
+			Protocols: ps.Protocols(),
+		}
+		if tls_config != nil {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		fmt.Fprintf(os.Stderr, "ListenAndServe fail, err=[%v]\n", err)
 	case "client":
 		go http.ListenAndServe(common.G.Client.DebugBindAddress, nil)
-		proxy.NewClientServer(
-			common.G.Client.BindAddress,
-			common.G.Client.ServerAddress,
-			*common.C.Dest).Start()
+		cs := proxy.NewClientServer(*common.C.Dest)
+		if cs == nil {
+			fmt.Fprintf(os.Stderr, "NewClientServer fail\n")
+			os.Exit(-1)
+		}
+		common.HandleReload(cs.Reload)
+		cs.Start()
 	}
 }
 
@@ -5,13 +5,21 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	log "third/seelog"
 	toml "third/toml"
 )
 
+// G is the config loaded at startup and never written after, the fields taken
+// again by a reload are read from the snapshot returned by Config
 var G etConfig
 var C etCommand
 
+var reloadLock sync.Mutex
+var current atomic.Pointer[etConfig]
+
 const (
 	MY_NAME string = "eTunnel"
 )
@@ -30,23 +38,148 @@ var (
 )
 
 type basic struct {
+	Obfuscation obfuscation `check:"Struct"`
+}
+
+// Shared by server and client, both ends must use the same settings
+type obfuscation struct {
+	Enable              bool     `check:"NOP"`
+	ConnectPath         string   `check:"NOP"`
+	DataPath            string   `check:"NOP"`
+	ParamSession        string   `check:"NOP"`
+	ParamAddr           string   `check:"NOP"`
+	ParamSeq            string   `check:"NOP"`
+	ParamHandshake      string   `check:"NOP"`
+	ParamAuthId         string   `check:"NOP"`
+	ParamTimestamp      string   `check:"NOP"`
+	ParamSignature      string   `check:"NOP"`
+	ParamMux            string   `check:"NOP"`
+	ParamAck            string   `check:"NOP"`
+	ParamTransport      string   `check:"NOP"`
+	ParamPayload        string   `check:"NOP"`
+	ParamCompress       string   `check:"NOP"`
+	ParamFilters        string   `check:"NOP"`
+	ParamVersion        string   `check:"NOP"`
+	ParamBlockSize      string   `check:"NOP"`
+	ParamReverse        string   `check:"NOP"`
+	PayloadHeader       string   `check:"NOP"`
+	PaddingMaxSize      int64    `check:"NOP"`
+	UserAgent           string   `check:"NOP"`
+	RequestContentType  string   `check:"NOP"`
+	ResponseContentType string   `check:"NOP"`
+	Headers             []string `check:"NOP"`
 }
 
 type server struct {
-	LogConfigFile        string `check:"StringNotEmpty"`
-	BindAddress          string `check:"StringNotEmpty"`
-	DebugBindAddress     string `check:"StringNotEmpty"`
-	ConnectionTimeoutSec int64  `check:"IntGTZero"`
-	KeepAliveTimeSec     int64  `check:"IntGTZero"`
-	PrivateKeyFilePath   string `check:"StringNotEmpty"`
+	LogConfigFile          string       `check:"StringNotEmpty"`
+	BindAddress            string       `check:"StringNotEmpty"`
+	DebugBindAddress       string       `check:"StringNotEmpty"`
+	ConnectionTimeoutSec   int64        `check:"IntGTZero"`
+	KeepAliveTimeSec       int64        `check:"IntGTZero"`
+	PrivateKeyFilePath     string       `check:"StringNotEmpty"`
+	EncryptData            bool         `check:"NOP"`
+	TLSCertFilePath        string       `check:"NOP"`
+	TLSKeyFilePath         string       `check:"NOP"`
+	AuthTimeWindowSec      int64        `check:"NOP"`
+	CredentialGraceSec     int64        `check:"NOP"`
+	Credentials            []credential `check:"StructSlice"`
+	AllowUnauthenticated   bool         `check:"NOP"`
+	AllowDestinations      []string     `check:"NOP"`
+	DenyDestinations       []string     `check:"NOP"`
+	TLSClientCAFilePath    string       `check:"NOP"`
+	MaxSessionsPerIdentity int64        `check:"NOP"`
+	Identities             []identity   `check:"StructSlice"`
+	PipelineWindow         int64        `check:"NOP"`
+	WebSocketEnable        bool         `check:"NOP"`
+	HTTP2Enable            bool         `check:"NOP"`
+	SplitEnable            bool         `check:"NOP"`
+	CompressionLevel       int64        `check:"NOP"`
+	Filters                []string     `check:"NOP"`
+	MaxBlockSize           int64        `check:"NOP"`
+	AllowReverseBinds      []string     `check:"NOP"`
+}
+
+type identity struct {
+	Name              string   `check:"StringNotEmpty"`
+	AllowDestinations []string `check:"NOP"`
+	DenyDestinations  []string `check:"NOP"`
+	MaxSessions       int64    `check:"NOP"`
+	AllowReverseBinds []string `check:"NOP"`
+}
+
+type credential struct {
+	Id     string `check:"StringNotEmpty"`
+	Secret string `check:"StringNotEmpty" mask:"true"`
 }
 
 type client struct {
-	LogConfigFile     string `check:"StringNotEmpty"`
-	BindAddress       string `check:"StringNotEmpty"`
-	DebugBindAddress  string `check:"StringNotEmpty"`
-	ServerAddress     string `check:"StringNotEmpty"`
-	PublicKeyFilePath string `check:"StringNotEmpty"`
+	LogConfigFile          string    `check:"StringNotEmpty"`
+	BindAddress            string    `check:"StringNotEmpty"`
+	DebugBindAddress       string    `check:"StringNotEmpty"`
+	ServerAddress          string    `check:"StringNotEmpty"`
+	PublicKeyFilePath      string    `check:"StringNotEmpty"`
+	TLSEnable              bool      `check:"NOP"`
+	TLSServerName          string    `check:"NOP"`
+	TLSCAFilePath          string    `check:"NOP"`
+	TLSPinSHA256           string    `check:"NOP"`
+	TLSCertFilePath        string    `check:"NOP"`
+	TLSKeyFilePath         string    `check:"NOP"`
+	AuthId                 string    `check:"NOP"`
+	AuthSecret             string    `check:"NOP" mask:"true"`
+	Multiplex              bool      `check:"NOP"`
+	PipelineWindow         int64     `check:"NOP"`
+	RetryCount             int64     `check:"NOP"`
+	Transport              string    `check:"NOP"`
+	UploadMethod           string    `check:"NOP"`
+	ProxyURL               string    `check:"NOP"`
+	ProxyUser              string    `check:"NOP"`
+	ProxyPassword          string    `check:"NOP" mask:"true"`
+	ProxyIgnoreEnvironment bool      `check:"NOP"`
+	CompressionLevel       int64     `check:"NOP"`
+	Filters                []string  `check:"NOP"`
+	MaxBlockSize           int64     `check:"NOP"`
+	ListenMode             string    `check:"NOP"`
+	ListenUser             string    `check:"NOP"`
+	ListenPassword         string    `check:"NOP" mask:"true"`
+	Forwards               []forward `check:"StructSlice"`
+}
+
+// Settings of one listener of the client
+type ClientConfig = client
+
+// A listener of the client besides the one of the client section. Fields left
+// out take the value of the client section, except ListenMode which is forward
+// unless set. The switches and numbers are pointers so a forward can set false
+// or 0, turning off or back to its default what the client section sets.
+type forward struct {
+	Name                   string   `check:"NOP"`
+	BindAddress            string   `check:"StringNotEmpty"`
+	Dest                   string   `check:"NOP"`
+	ListenMode             string   `check:"NOP"`
+	ServerAddress          string   `check:"NOP"`
+	PublicKeyFilePath      string   `check:"NOP"`
+	TLSEnable              *bool    `check:"NOP"`
+	TLSServerName          string   `check:"NOP"`
+	TLSCAFilePath          string   `check:"NOP"`
+	TLSPinSHA256           string   `check:"NOP"`
+	TLSCertFilePath        string   `check:"NOP"`
+	TLSKeyFilePath         string   `check:"NOP"`
+	AuthId                 string   `check:"NOP"`
+	AuthSecret             string   `check:"NOP" mask:"true"`
+	Multiplex              *bool    `check:"NOP"`
+	PipelineWindow         *int64   `check:"NOP"`
+	RetryCount             *int64   `check:"NOP"`
+	Transport              string   `check:"NOP"`
+	UploadMethod           string   `check:"NOP"`
+	ProxyURL               string   `check:"NOP"`
+	ProxyUser              string   `check:"NOP"`
+	ProxyPassword          string   `check:"NOP" mask:"true"`
+	ProxyIgnoreEnvironment *bool    `check:"NOP"`
+	CompressionLevel       *int64   `check:"NOP"`
+	Filters                []string `check:"NOP"`
+	MaxBlockSize           *int64   `check:"NOP"`
+	ListenUser             string   `check:"NOP"`
+	ListenPassword         string   `check:"NOP" mask:"true"`
 }
 
 type etCommand struct {
@@ -56,6 +189,10 @@ type etCommand struct {
 	Foreground   *bool
 	Type         *string
 	Dest         *string
+	PrivateKey   *string
+	PublicKey    *string
+	KeyBits      *int
+	Args         []string
 }
 
 ////////////////////////////////////////////////////////////////////////////////////////////////////
@@ -66,9 +203,13 @@ func (self *etCommand) parseCommand(args []string) {
 	self.LogConfFile = flagset.String("logconf", "", "Path to config file")
 	self.PrintVersion = flagset.Bool("version", false, "Print etunnel version")
 	self.Foreground = flagset.Bool("fg", false, "Start server in foreground")
-	self.Type = flagset.String("type", "", "eTunnel type server/client")
+	self.Type = flagset.String("type", "", "eTunnel type server/client/keygen/keyinfo")
 	self.Dest = flagset.String("dest", "", "eTunnel destination address")
+	self.PrivateKey = flagset.String("pri", "./etc/key.pri", "Path to private key file written by keygen")
+	self.PublicKey = flagset.String("pub", "./etc/key.pub", "Path to public key file written by keygen")
+	self.KeyBits = flagset.Int("bits", DEFAULT_KEY_BITS, "RSA key bits for keygen")
 	flagset.Parse(args[1:])
+	self.Args = flagset.Args()
 
 	if *self.PrintVersion {
 		fmt.Fprintf(os.Stdout, "%s\n", MY_NAME)
@@ -88,23 +229,148 @@ func (self etConfig) String() string {
 	return configStringStruct(MY_NAME, self)
 }
 
+// Keys matching no field are refused, the decoder would drop a misspelled key silently
+func decodeConfigFile(path string, cfg *etConfig) (err error) {
+	md, err := toml.DecodeFile(path, cfg)
+	if err != nil {
+		return err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, 0, len(undecoded))
+		for _, key := range undecoded {
+			keys = append(keys, key.String())
+		}
+		return fmt.Errorf("unknown config keys, keys=[%s]", strings.Join(keys, ","))
+	}
+	return err
+}
+
+// The config of the last reload, or the one loaded at startup. A snapshot is
+// never modified once published, readers may keep it as long as they like.
+func Config() *etConfig {
+	return current.Load()
+}
+
+// Only key material and credentials are taken from the new config file,
+// everything else keeps the value loaded at startup. Must be called with
+// reloadLock held.
+func reloadConfig() (err error) {
+	var cfg etConfig
+	if err = decodeConfigFile(*C.ConfigFile, &cfg); err != nil {
+		return fmt.Errorf("config file parse fail, err=[%s] file=[%s]", err.Error(), *C.ConfigFile)
+	} else if err = cfg.check(); err != nil {
+		return fmt.Errorf("config check fail, err=[%s]", err.Error())
+	} else if len(cfg.Client.Forwards) != len(G.Client.Forwards) {
+		return fmt.Errorf("add or remove client.Forwards needs restart")
+	}
+	for i := range cfg.Client.Forwards {
+		if cfg.Client.Forwards[i].BindAddress != G.Client.Forwards[i].BindAddress {
+			return fmt.Errorf("change client.Forwards[%d].BindAddress needs restart", i)
+		}
+	}
+
+	next := *Config()
+	next.Client.Forwards = append([]forward{}, next.Client.Forwards...)
+	next.Server.PrivateKeyFilePath = cfg.Server.PrivateKeyFilePath
+	next.Server.TLSCertFilePath = cfg.Server.TLSCertFilePath
+	next.Server.TLSKeyFilePath = cfg.Server.TLSKeyFilePath
+	next.Server.TLSClientCAFilePath = cfg.Server.TLSClientCAFilePath
+	next.Server.AuthTimeWindowSec = cfg.Server.AuthTimeWindowSec
+	next.Server.CredentialGraceSec = cfg.Server.CredentialGraceSec
+	next.Server.Credentials = cfg.Server.Credentials
+	next.Server.AllowUnauthenticated = cfg.Server.AllowUnauthenticated
+
+	next.Client.PublicKeyFilePath = cfg.Client.PublicKeyFilePath
+	next.Client.TLSServerName = cfg.Client.TLSServerName
+	next.Client.TLSCAFilePath = cfg.Client.TLSCAFilePath
+	next.Client.TLSPinSHA256 = cfg.Client.TLSPinSHA256
+	next.Client.TLSCertFilePath = cfg.Client.TLSCertFilePath
+	next.Client.TLSKeyFilePath = cfg.Client.TLSKeyFilePath
+	next.Client.AuthId = cfg.Client.AuthId
+	next.Client.AuthSecret = cfg.Client.AuthSecret
+	next.Client.ListenUser = cfg.Client.ListenUser
+	next.Client.ListenPassword = cfg.Client.ListenPassword
+	for i := range next.Client.Forwards {
+		f, reloaded := &next.Client.Forwards[i], &cfg.Client.Forwards[i]
+		f.PublicKeyFilePath = reloaded.PublicKeyFilePath
+		f.TLSServerName = reloaded.TLSServerName
+		f.TLSCAFilePath = reloaded.TLSCAFilePath
+		f.TLSPinSHA256 = reloaded.TLSPinSHA256
+		f.TLSCertFilePath = reloaded.TLSCertFilePath
+		f.TLSKeyFilePath = reloaded.TLSKeyFilePath
+		f.AuthId = reloaded.AuthId
+		f.AuthSecret = reloaded.AuthSecret
+		f.ListenUser = reloaded.ListenUser
+		f.ListenPassword = reloaded.ListenPassword
+	}
+
+	current.Store(&next)
+
+	log.Infof("reload config succ, %s", next.String())
+	return err
+}
+
+func (self *etCommand) keygen() {
+	key, err := GenerateKeyPair(*self.PrivateKey, *self.PublicKey, *self.KeyBits)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "keygen fail, err=[%s]\n", err.Error())
+		os.Exit(-1)
+	}
+	fmt.Fprintf(os.Stdout, "Private key:  %s\n", *self.PrivateKey)
+	fmt.Fprintf(os.Stdout, "Public key:   %s\n", *self.PublicKey)
+	fmt.Fprintf(os.Stdout, "Fingerprint:  %s (RSA %d)\n", KeyFingerprint(&key.PublicKey), key.N.BitLen())
+	os.Exit(0)
+}
+
+// Show fingerprints of the files given as arguments, or the public key file by default
+func (self *etCommand) keyinfo() {
+	paths := self.Args
+	if len(paths) == 0 {
+		paths = []string{*self.PublicKey}
+	}
+	ret := 0
+	for _, path := range paths {
+		fingerprint, bits, err := LoadKeyFingerprint(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: load key fail, err=[%s]\n", path, err.Error())
+			ret = -1
+		} else {
+			fmt.Fprintf(os.Stdout, "%s: %s (RSA %d)\n", path, fingerprint, bits)
+			if bits < MIN_KEY_BITS {
+				fmt.Fprintf(os.Stderr, "%s: key bits too small to be loaded, min=%d\n", path, MIN_KEY_BITS)
+				ret = -1
+			}
+		}
+	}
+	os.Exit(ret)
+}
+
 func ParseCommandAndFile() error {
 	C.parseCommand(os.Args)
 
+	switch *C.Type {
+	case "keygen":
+		C.keygen()
+	case "keyinfo":
+		C.keyinfo()
+	}
+
 	if *C.Type != "server" &&
 		*C.Type != "client" {
-		fmt.Fprintf(os.Stderr, "type must be 'server' or 'client'\n")
+		fmt.Fprintf(os.Stderr, "type must be 'server', 'client', 'keygen' or 'keyinfo'\n")
 		os.Exit(-1)
 	}
 
-	if *C.Type == "client" && *C.Dest == "" {
-		fmt.Fprintf(os.Stderr, "addr can not be empty while type is client\n")
+	err := decodeConfigFile(*C.ConfigFile, &G)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config file parse fail, err=[%s] file=[%s]\n", err.Error(), *C.ConfigFile)
 		os.Exit(-1)
 	}
 
-	_, err := toml.DecodeFile(*C.ConfigFile, &G)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "config file parse fail, err=[%s] file=[%s]\n", err.Error(), *C.ConfigFile)
+	// listeners of the proxy modes take the destination from their clients, forwards have their own
+	if *C.Type == "client" && *C.Dest == "" && len(G.Client.Forwards) == 0 &&
+		(G.Client.ListenMode == "" || G.Client.ListenMode == "forward" || G.Client.ListenMode == "reverse") {
+		fmt.Fprintf(os.Stderr, "addr can not be empty while type is client\n")
 		os.Exit(-1)
 	}
 
@@ -134,6 +400,63 @@ func ParseCommandAndFile() error {
 	}
 	log.ReplaceLogger(logger)
 
+	snapshot := G
+	current.Store(&snapshot)
+
 	log.Infof("parse config succ, %s", G.String())
 	return err
 }
+
+// Settings of forward i of the client, or of the listener of the client section itself while i is -1
+func (self *client) ListenerConfig(i int) (c *ClientConfig) {
+	c = &ClientConfig{}
+	*c = *self
+	c.Forwards = nil
+	if i < 0 {
+		return c
+	}
+	f := &self.Forwards[i]
+	c.BindAddress = f.BindAddress
+	c.ListenMode = f.ListenMode
+	c.ServerAddress = ValueOrDefault(f.ServerAddress, c.ServerAddress)
+	c.PublicKeyFilePath = ValueOrDefault(f.PublicKeyFilePath, c.PublicKeyFilePath)
+	if f.TLSEnable != nil {
+		c.TLSEnable = *f.TLSEnable
+	}
+	c.TLSServerName = ValueOrDefault(f.TLSServerName, c.TLSServerName)
+	c.TLSCAFilePath = ValueOrDefault(f.TLSCAFilePath, c.TLSCAFilePath)
+	c.TLSPinSHA256 = ValueOrDefault(f.TLSPinSHA256, c.TLSPinSHA256)
+	c.TLSCertFilePath = ValueOrDefault(f.TLSCertFilePath, c.TLSCertFilePath)
+	c.TLSKeyFilePath = ValueOrDefault(f.TLSKeyFilePath, c.TLSKeyFilePath)
+	c.AuthId = ValueOrDefault(f.AuthId, c.AuthId)
+	c.AuthSecret = ValueOrDefault(f.AuthSecret, c.AuthSecret)
+	if f.Multiplex != nil {
+		c.Multiplex = *f.Multiplex
+	}
+	if f.PipelineWindow != nil {
+		c.PipelineWindow = *f.PipelineWindow
+	}
+	if f.RetryCount != nil {
+		c.RetryCount = *f.RetryCount
+	}
+	c.Transport = ValueOrDefault(f.Transport, c.Transport)
+	c.UploadMethod = ValueOrDefault(f.UploadMethod, c.UploadMethod)
+	c.ProxyURL = ValueOrDefault(f.ProxyURL, c.ProxyURL)
+	c.ProxyUser = ValueOrDefault(f.ProxyUser, c.ProxyUser)
+	c.ProxyPassword = ValueOrDefault(f.ProxyPassword, c.ProxyPassword)
+	if f.ProxyIgnoreEnvironment != nil {
+		c.ProxyIgnoreEnvironment = *f.ProxyIgnoreEnvironment
+	}
+	if f.CompressionLevel != nil {
+		c.CompressionLevel = *f.CompressionLevel
+	}
+	if len(f.Filters) > 0 {
+		c.Filters = f.Filters
+	}
+	if f.MaxBlockSize != nil {
+		c.MaxBlockSize = *f.MaxBlockSize
+	}
+	c.ListenUser = ValueOrDefault(f.ListenUser, c.ListenUser)
+	c.ListenPassword = ValueOrDefault(f.ListenPassword, c.ListenPassword)
+	return c
+}
@@ -16,6 +16,7 @@ func init() {
 		"StringNotEmpty":      checkStringNotEmpty,
 		"StringSliceNotEmpty": checkStringSliceNotEmpty,
 		"StructSliceNotEmpty": checkStructSliceNotEmpty,
+		"StructSlice":         checkStructSlice,
 		"Struct":              configCheckStruct,
 	}
 }
@@ -93,6 +94,14 @@ func checkStructSliceNotEmpty(name string, d interface{}) (err error) {
 	return err
 }
 
+func checkStructSlice(name string, d interface{}) (err error) {
+	v := reflect.ValueOf(d)
+	for i := 0; i < v.Len() && err == nil; i++ {
+		err = configCheckStruct(fmt.Sprintf("%s[%d]", name, i), v.Index(i).Interface())
+	}
+	return err
+}
+
 func configCheckStruct(host string, d interface{}) (err error) {
 	t := reflect.TypeOf(d)
 	v := reflect.ValueOf(d)
@@ -119,6 +128,16 @@ func configStringStruct(host string, d interface{}) (ret string) {
 		}
 		if reflect.Struct == vfield.Kind() {
 			ret += configStringStruct(host+"."+tfield.Name, vfield.Interface())
+		} else if reflect.Slice == vfield.Kind() && reflect.Struct == vfield.Type().Elem().Kind() {
+			for j := 0; j < vfield.Len(); j++ {
+				ret += configStringStruct(fmt.Sprintf("%s.%s[%d]", host, tfield.Name, j), vfield.Index(j).Interface())
+			}
+		} else if reflect.Ptr == vfield.Kind() {
+			if !vfield.IsNil() {
+				ret += fmt.Sprintf("\n\t%s=%v", host+"."+tfield.Name, vfield.Elem().Interface())
+			}
+		} else if tfield.Tag.Get("mask") == "true" && vfield.String() != "" {
+			ret += fmt.Sprintf("\n\t%s=******", host+"."+tfield.Name)
 		} else {
 			ret += fmt.Sprintf("\n\t%s=%v", host+"."+tfield.Name, vfield.Interface())
 		}
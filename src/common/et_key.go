@@ -0,0 +1,156 @@
+package common
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+)
+
+const (
+	DEFAULT_KEY_BITS int = 2048
+	MIN_KEY_BITS     int = 2048
+)
+
+func readPEMBlock(path string) (block *pem.Block, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ = pem.Decode(data)
+	if block == nil {
+		err = fmt.Errorf("no pem block found, path=[%s]", path)
+	}
+	return block, err
+}
+
+// Keys smaller than MIN_KEY_BITS are refused, the handshake is signed with them
+func checkKeyBits(key *rsa.PublicKey, path string) (err error) {
+	if bits := key.N.BitLen(); bits < MIN_KEY_BITS {
+		err = fmt.Errorf("key bits too small, bits=%d min=%d path=[%s]", bits, MIN_KEY_BITS, path)
+	}
+	return err
+}
+
+func LoadPrivateKey(path string) (key *rsa.PrivateKey, err error) {
+	if key, err = parsePrivateKey(path); err == nil {
+		if err = checkKeyBits(&key.PublicKey, path); err != nil {
+			key = nil
+		}
+	}
+	return key, err
+}
+
+func LoadPublicKey(path string) (key *rsa.PublicKey, err error) {
+	if key, err = parsePublicKey(path); err == nil {
+		if err = checkKeyBits(key, path); err != nil {
+			key = nil
+		}
+	}
+	return key, err
+}
+
+func parsePrivateKey(path string) (key *rsa.PrivateKey, err error) {
+	block, err := readPEMBlock(path)
+	if err != nil {
+		return nil, err
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		var k interface{}
+		if k, err = x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+			var ok bool
+			if key, ok = k.(*rsa.PrivateKey); !ok {
+				err = fmt.Errorf("not a rsa private key, path=[%s]", path)
+			}
+		}
+	default:
+		err = fmt.Errorf("unsupported private key type, type=[%s] path=[%s]", block.Type, path)
+	}
+	return key, err
+}
+
+// Fingerprint of the DER encoded public key, in the same form as ssh-keygen -l
+func KeyFingerprint(key *rsa.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "invalid"
+	}
+	sum := sha256.Sum256(der)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+func writePEMFile(path string, perm os.FileMode, block *pem.Block) (err error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if err = pem.Encode(file, block); err != nil {
+		file.Close()
+		os.Remove(path)
+	} else if err = file.Close(); err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// Existing files are never overwritten, the private key is only readable by the owner
+func GenerateKeyPair(private_path string, public_path string, bits int) (key *rsa.PrivateKey, err error) {
+	var der []byte
+	if bits < MIN_KEY_BITS {
+		err = fmt.Errorf("key bits too small, bits=%d min=%d", bits, MIN_KEY_BITS)
+	} else if key, err = rsa.GenerateKey(rand.Reader, bits); err != nil {
+		err = fmt.Errorf("generate key fail, err=[%v]", err)
+	} else if der, err = x509.MarshalPKIXPublicKey(&key.PublicKey); err != nil {
+		err = fmt.Errorf("marshal public key fail, err=[%v]", err)
+	} else if err = writePEMFile(private_path, 0600, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}); err != nil {
+		err = fmt.Errorf("write private key fail, err=[%v]", err)
+	} else if err = writePEMFile(public_path, 0644, &pem.Block{Type: "PUBLIC KEY", Bytes: der}); err != nil {
+		os.Remove(private_path)
+		err = fmt.Errorf("write public key fail, err=[%v]", err)
+	}
+	if err != nil {
+		key = nil
+	}
+	return key, err
+}
+
+// Accept both private and public key files, the fingerprint is always of the public part.
+// Keys too small to be loaded are still shown, so they can be told apart.
+func LoadKeyFingerprint(path string) (fingerprint string, bits int, err error) {
+	var public_key *rsa.PublicKey
+	if private_key, tmp_err := parsePrivateKey(path); tmp_err == nil {
+		public_key = &private_key.PublicKey
+	} else if public_key, err = parsePublicKey(path); err != nil {
+		return fingerprint, bits, err
+	}
+	return KeyFingerprint(public_key), public_key.N.BitLen(), err
+}
+
+func parsePublicKey(path string) (key *rsa.PublicKey, err error) {
+	block, err := readPEMBlock(path)
+	if err != nil {
+		return nil, err
+	}
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		var k interface{}
+		if k, err = x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+			var ok bool
+			if key, ok = k.(*rsa.PublicKey); !ok {
+				err = fmt.Errorf("not a rsa public key, path=[%s]", path)
+			}
+		}
+	default:
+		err = fmt.Errorf("unsupported public key type, type=[%s] path=[%s]", block.Type, path)
+	}
+	return key, err
+}
@@ -0,0 +1,70 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	log "third/seelog"
+)
+
+const (
+	ADMIN_RELOAD_PATH string = "/admin/reload"
+)
+
+// Reload key material and credentials on SIGHUP or a POST to ADMIN_RELOAD_PATH
+// of the debug address, the config file is parsed again before reload is called.
+// One reload runs at a time so reload always builds on the previous generation.
+// The admin path takes only loopback requests carrying no Origin, a browser page
+// can not trigger it.
+func HandleReload(reload func() error) {
+	do_reload := func(trigger string) (err error) {
+		reloadLock.Lock()
+		defer reloadLock.Unlock()
+		if err = reloadConfig(); err != nil {
+			log.Warnf("reload config fail, trigger=[%s] err=[%v]", trigger, err)
+		} else if err = reload(); err != nil {
+			log.Warnf("reload fail, trigger=[%s] err=[%v]", trigger, err)
+		} else {
+			log.Infof("reload succ, trigger=[%s]", trigger)
+		}
+		return err
+	}
+
+	sig_chan := make(chan os.Signal, 1)
+	signal.Notify(sig_chan, syscall.SIGHUP)
+	go func() {
+		for _ = range sig_chan {
+			do_reload("SIGHUP")
+		}
+	}()
+
+	http.HandleFunc(ADMIN_RELOAD_PATH, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !isLoopback(r.RemoteAddr) || r.Header.Get("Origin") != "" {
+			log.Warnf("admin reload refused, remote=[%s] origin=[%s]", r.RemoteAddr, r.Header.Get("Origin"))
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if err := do_reload("admin " + r.RemoteAddr); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "reload fail, err=[%v]\n", err)
+		} else {
+			fmt.Fprintf(w, "reload succ\n")
+		}
+	})
+}
+
+func isLoopback(remote string) bool {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -11,3 +11,11 @@ func GetCurrentTime() int64 {
 func upper_align(v uint64, align_size uint64) uint64 {
 	return (v + align_size - 1) & (^(align_size - 1))
 }
+
+// The value, or default_value while it is empty
+func ValueOrDefault(value string, default_value string) string {
+	if value == "" {
+		return default_value
+	}
+	return value
+}
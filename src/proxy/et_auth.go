@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	"common"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	log "third/seelog"
+)
+
+// Requests are signed with hmac-sha256 over the method, the path and all query
+// parameters except the signature itself. Connect requests are signed with the
+// client credential, the timestamp limits how long a captured one is valid and
+// the server remembers the signatures it accepted for that long, so none is
+// accepted twice. A server without credentials or a client ca refuses to start
+// unless AllowUnauthenticated is set. Data requests are signed with the mac key of the session, so the session id
+// alone is useless to anyone who did not take part in the handshake. From
+// PayloadSignVersion on they also sign the sha256 of the payload they carry in
+// the body or a header, so it can not be swapped while EncryptData is off.
+const (
+	DefaultAuthTimeWindowSec  int64 = 300
+	DefaultCredentialGraceSec int64 = 300
+	PayloadSignVersion        int   = 4
+	ReplaySweepIntervalSec    int64 = 60
+)
+
+type iAuthenticator interface {
+	verify(r *http.Request) (id string, err error)
+	enabled() bool
+	reload() (iAuthenticator, error)
+}
+
+type authenticator struct {
+	secrets       map[string][]byte
+	timeWindowSec int64
+	// secrets replaced by the last reload, accepted until previousExpire
+	previous       map[string][]byte
+	previousExpire int64
+	// shared by the authenticators of all reloads
+	accepted *replayCache
+}
+
+// Signatures of the connects accepted, each kept until its timestamp is out of window
+type replayCache struct {
+	lock      sync.Mutex
+	seen      map[string]int64
+	nextSweep int64
+}
+
+// accepted is nil at startup, a reload passes the one of the authenticator it replaces
+func newAuthenticator(accepted *replayCache) (auth iAuthenticator, err error) {
+	c := &common.Config().Server
+	auth_impl := &authenticator{
+		secrets:       make(map[string][]byte),
+		timeWindowSec: c.AuthTimeWindowSec,
+		accepted:      accepted,
+	}
+	if auth_impl.timeWindowSec <= 0 {
+		auth_impl.timeWindowSec = DefaultAuthTimeWindowSec
+	}
+	if auth_impl.accepted == nil {
+		auth_impl.accepted = newReplayCache()
+	}
+	for _, c := range c.Credentials {
+		auth_impl.secrets[c.Id] = []byte(c.Secret)
+	}
+	if len(auth_impl.secrets) != 0 {
+		log.Infof("client authentication enabled, credentials=%d timeWindowSec=%d", len(auth_impl.secrets), auth_impl.timeWindowSec)
+	} else if c.TLSClientCAFilePath != "" {
+		log.Infof("no credential configured, clients authenticated by certificate only")
+	} else if c.AllowUnauthenticated {
+		log.Warnf("no credential configured, client authentication disabled by AllowUnauthenticated")
+	} else {
+		return auth, fmt.Errorf("no credential configured, set server.Credentials, server.TLSClientCAFilePath or server.AllowUnauthenticated")
+	}
+	auth = auth_impl
+	return auth, err
+}
+
+func (self *authenticator) enabled() bool {
+	return len(self.secrets) != 0
+}
+
+// Build from the current config, secrets of self stay valid for CredentialGraceSec
+func (self *authenticator) reload() (auth iAuthenticator, err error) {
+	grace_sec := common.Config().Server.CredentialGraceSec
+	if grace_sec <= 0 {
+		grace_sec = DefaultCredentialGraceSec
+	}
+	if auth, err = newAuthenticator(self.accepted); err != nil {
+		return auth, err
+	}
+	auth_impl := auth.(*authenticator)
+	auth_impl.previous = self.secrets
+	auth_impl.previousExpire = common.GetCurrentTime() + grace_sec*1000000
+	log.Infof("previous credentials accepted in grace window, credentials=%d graceSec=%d", len(self.secrets), grace_sec)
+	return auth, err
+}
+
+func (self *authenticator) verify(r *http.Request) (id string, err error) {
+	if !self.enabled() {
+		return id, err
+	}
+	q := r.URL.Query()
+	id = q.Get(QK_AUTH_ID)
+	secret, exist := self.secrets[id]
+	timestamp, tmp_err := strconv.ParseInt(q.Get(QK_TIMESTAMP), 10, 64)
+	now := common.GetCurrentTime() / 1000000
+	if id == "" {
+		err = fmt.Errorf("no credential")
+	} else if tmp_err != nil {
+		err = fmt.Errorf("invalid timestamp, err=[%v]", tmp_err)
+	} else if timestamp < now-self.timeWindowSec || timestamp > now+self.timeWindowSec {
+		err = fmt.Errorf("timestamp out of window, timestamp=%d now=%d", timestamp, now)
+	} else if exist && checkRequestSignature(secret, r.Method, r.URL.Path, q, nil) {
+		err = nil
+	} else if self.verifyPrevious(id, r.Method, r.URL.Path, q) {
+		log.Infof("accept previous credential in grace window, id=[%s]", id)
+	} else if !exist {
+		err = fmt.Errorf("unknown credential, id=[%s]", id)
+	} else {
+		err = fmt.Errorf("signature mismatch, id=[%s]", id)
+	}
+	if err == nil && !self.accepted.add(q.Get(QK_SIGNATURE), (timestamp+self.timeWindowSec)*1000000) {
+		err = fmt.Errorf("replayed request, id=[%s] timestamp=%d", id, timestamp)
+	}
+	return id, err
+}
+
+func (self *authenticator) verifyPrevious(id string, method string, path string, q url.Values) bool {
+	secret, exist := self.previous[id]
+	return exist &&
+		common.GetCurrentTime() < self.previousExpire &&
+		checkRequestSignature(secret, method, path, q, nil)
+}
+
+func newReplayCache() (rc *replayCache) {
+	rc = &replayCache{
+		seen: make(map[string]int64),
+	}
+	return rc
+}
+
+// False while signature was accepted before and has not expired, the expired ones are swept now and then
+func (self *replayCache) add(signature string, expire_us int64) bool {
+	now := common.GetCurrentTime()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if now >= self.nextSweep {
+		for k, expire := range self.seen {
+			if expire <= now {
+				delete(self.seen, k)
+			}
+		}
+		self.nextSweep = now + ReplaySweepIntervalSec*1000000
+	}
+	if expire, exist := self.seen[signature]; exist && expire > now {
+		return false
+	}
+	self.seen[signature] = expire_us
+	return true
+}
+
+// Nil while the session is older than PayloadSignVersion, the payload is not signed then
+func payloadHash(version int, payload []byte) []byte {
+	if version < PayloadSignVersion {
+		return nil
+	}
+	sum := sha256.Sum256(payload)
+	return sum[:]
+}
+
+func requestSignature(secret []byte, method string, path string, q url.Values, payload_hash []byte) string {
+	signed := url.Values{}
+	for k, v := range q {
+		if k != QK_SIGNATURE {
+			signed[k] = v
+		}
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(strings.TrimPrefix(path, "/")))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(signed.Encode()))
+	if payload_hash != nil {
+		mac.Write([]byte{'\n'})
+		mac.Write(payload_hash)
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func checkRequestSignature(secret []byte, method string, path string, q url.Values, payload_hash []byte) bool {
+	expect := requestSignature(secret, method, path, q, payload_hash)
+	return hmac.Equal([]byte(expect), []byte(q.Get(QK_SIGNATURE)))
+}
+
+// Sign data requests with the mac key of the session, the seq makes every signature unique
+func signSessionRequest(mac_key []byte, method string, u *url.URL, payload_hash []byte) {
+	q := u.Query()
+	q.Set(QK_SIGNATURE, requestSignature(mac_key, method, u.Path, q, payload_hash))
+	u.RawQuery = q.Encode()
+}
+
+// Add credential id, timestamp and signature to the query, nothing to do while no credential configured
+func signRequest(id string, secret []byte, method string, u *url.URL) {
+	if id == "" {
+		return
+	}
+	q := u.Query()
+	q.Set(QK_AUTH_ID, id)
+	q.Set(QK_TIMESTAMP, strconv.FormatInt(common.GetCurrentTime()/1000000, 10))
+	q.Set(QK_SIGNATURE, requestSignature(secret, method, u.Path, q, nil))
+	u.RawQuery = q.Encode()
+}
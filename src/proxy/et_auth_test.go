@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"common"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+func signedTestConnect(id string, secret string, timestamp int64, nonce string) *http.Request {
+	u := &url.URL{Path: "/" + QP_CONNECT}
+	q := url.Values{}
+	q.Set(QK_HANDSHAKE, nonce)
+	q.Set(QK_AUTH_ID, id)
+	q.Set(QK_TIMESTAMP, strconv.FormatInt(timestamp, 10))
+	q.Set(QK_SIGNATURE, requestSignature([]byte(secret), http.MethodGet, u.Path, q, nil))
+	u.RawQuery = q.Encode()
+	return httptest.NewRequest(http.MethodGet, u.String(), nil)
+}
+
+func TestAuthenticatorVerify(t *testing.T) {
+	now := common.GetCurrentTime() / 1000000
+	auth := &authenticator{
+		secrets:        map[string][]byte{"laptop": []byte("secret")},
+		timeWindowSec:  300,
+		previous:       map[string][]byte{"laptop": []byte("old"), "retired": []byte("gone")},
+		previousExpire: common.GetCurrentTime() + 60*1000000,
+		accepted:       newReplayCache(),
+	}
+	replayed := signedTestConnect("laptop", "secret", now, "replayed")
+	cases := []struct {
+		name  string
+		r     *http.Request
+		valid bool
+	}{
+		{"signed", signedTestConnect("laptop", "secret", now, "a"), true},
+		{"first of a replayed one", replayed, true},
+		{"replayed", replayed, false},
+		{"signed by previous secret", signedTestConnect("laptop", "old", now, "b"), true},
+		{"previous credential", signedTestConnect("retired", "gone", now, "c"), true},
+		{"wrong secret", signedTestConnect("laptop", "guess", now, "d"), false},
+		{"unknown credential", signedTestConnect("phone", "secret", now, "e"), false},
+		{"no credential", httptest.NewRequest(http.MethodGet, "/"+QP_CONNECT, nil), false},
+		{"timestamp too old", signedTestConnect("laptop", "secret", now-301, "f"), false},
+		{"timestamp too new", signedTestConnect("laptop", "secret", now+301, "g"), false},
+		{"timestamp at window edge", signedTestConnect("laptop", "secret", now-299, "h"), true},
+	}
+	for _, c := range cases {
+		if _, err := auth.verify(c.r); (err == nil) != c.valid {
+			t.Fatalf("%s: err=[%v] valid=%t", c.name, err, c.valid)
+		}
+	}
+}
+
+func TestReplayCache(t *testing.T) {
+	now := common.GetCurrentTime()
+	rc := newReplayCache()
+	cases := []struct {
+		name      string
+		signature string
+		expire_us int64
+		accepted  bool
+	}{
+		{"first", "a", now + 1000000, true},
+		{"again", "a", now + 1000000, false},
+		{"other", "b", now + 1000000, true},
+		{"expired", "c", now - 1, true},
+		{"again once expired", "c", now + 1000000, true},
+		{"again before expired", "c", now + 1000000, false},
+	}
+	for _, c := range cases {
+		if accepted := rc.add(c.signature, c.expire_us); accepted != c.accepted {
+			t.Fatalf("%s: accepted=%t want=%t", c.name, accepted, c.accepted)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"sync/atomic"
+)
+
+// Every block read from the tcp connection is encoded into one line of
+// standard base64, for intermediaries that only pass text.
+type base64Filter struct {
+	pending []byte
+	encoded int64
+}
+
+func newBase64Filter() (bf *base64Filter) {
+	bf = &base64Filter{}
+	return bf
+}
+
+func (self *base64Filter) onDataRecv(dn *dataBlock) (*dataBlock, error) {
+	line := make([]byte, base64.StdEncoding.EncodedLen(len(dn.data))+1)
+	base64.StdEncoding.Encode(line, dn.data)
+	line[len(line)-1] = '\n'
+	atomic.AddInt64(&self.encoded, 1)
+	return &dataBlock{data: line}, nil
+}
+
+// stream decoding
+func (self *base64Filter) onDataSend(dn *dataBlock) (*dataBlock, error) {
+	self.pending = append(self.pending, dn.data...)
+	var plain []byte
+	for {
+		i := bytes.IndexByte(self.pending, '\n')
+		if i < 0 {
+			break
+		}
+		data := make([]byte, base64.StdEncoding.DecodedLen(i))
+		n, err := base64.StdEncoding.Decode(data, self.pending[:i])
+		if err != nil {
+			return nil, fmt.Errorf("decode base64 line fail, err=[%v]", err)
+		}
+		plain = append(plain, data[:n]...)
+		self.pending = self.pending[i+1:]
+	}
+	if int64(len(self.pending)) > int64(base64.StdEncoding.EncodedLen(int(DataBlockSize))) {
+		return nil, fmt.Errorf("base64 line too long, len=%d", len(self.pending))
+	}
+	if len(self.pending) == 0 {
+		self.pending = nil
+	}
+	if len(plain) == 0 {
+		return nil, nil
+	}
+	return &dataBlock{data: plain}, nil
+}
+
+// The encoded line of a block must not exceed DataBlockSize
+func (self *base64Filter) dataBlockSize() int64 {
+	return (DataBlockSize - 1) / 4 * 3
+}
+
+func (self *base64Filter) String() string {
+	return fmt.Sprintf("base64=[encoded=%d]", atomic.LoadInt64(&self.encoded))
+}
@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBase64FilterRoundTrip(t *testing.T) {
+	cases := []struct {
+		name   string
+		blocks [][]byte
+	}{
+		{"empty block", testBlocks(0)},
+		{"largest block", testBlocks(int(newBase64Filter().dataBlockSize()))},
+		{"sizes needing padding", testBlocks(1, 2, 3, 4)},
+		{"bytes outside text", [][]byte{{0, '\n', 0xff, '='}}},
+	}
+	for _, c := range cases {
+		lines := roundTripFilter(t, c.name, func() (iFilter, iFilter) {
+			return newBase64Filter(), newBase64Filter()
+		}, c.blocks)
+		for _, line := range lines {
+			if bytes.IndexByte(line, '\n') != len(line)-1 {
+				t.Fatalf("%s: line=[%q] is not one line", c.name, line)
+			}
+		}
+	}
+}
+
+func TestBase64FilterRejects(t *testing.T) {
+	cases := []struct {
+		name string
+		wire []byte
+	}{
+		{"not base64", []byte("!!!!\n")},
+		{"truncated quantum", []byte("QUJ\n")},
+		{"line too long", bytes.Repeat([]byte("A"), int(DataBlockSize*2))},
+	}
+	for _, c := range cases {
+		if _, err := newBase64Filter().onDataSend(&dataBlock{data: c.wire}); err == nil {
+			t.Fatalf("%s: invalid line decoded", c.name)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// Every block read from the tcp connection is deflated on its own into one frame:
+//
+//	| type (1 byte) | length (4 bytes) | payload |
+//
+// A block that does not shrink is stored as is. Blocks after it are stored
+// without trying for a while, growing up to compressSkipMax blocks while they
+// keep failing, so an already compressed or encrypted stream costs little.
+const (
+	compressFrameHeaderSize int64 = 5
+	compressFrameStored     byte  = 0
+	compressFrameDeflate    byte  = 1
+	compressMinSize         int   = 128
+	compressSkipMax         int64 = 64
+)
+
+type compressFilter struct {
+	level    int
+	writer   *flate.Writer
+	reader   io.ReadCloser
+	buf      bytes.Buffer
+	pending  []byte
+	skip     int64
+	skipNext int64
+	// stats, raw and compressed bytes of each direction
+	deflateIn  int64
+	deflateOut int64
+	inflateIn  int64
+	inflateOut int64
+	stored     int64
+}
+
+func checkCompressLevel(level int64) (err error) {
+	if level < 0 || level > flate.BestCompression {
+		err = fmt.Errorf("invalid compression level, level=%d, must be 1 to 9 or 0 to disable", level)
+	}
+	return err
+}
+
+// level applies to the blocks deflated here, the peer inflates whatever level it gets
+func newCompressFilter(level int) (cf *compressFilter, err error) {
+	cf_impl := &compressFilter{
+		level:  level,
+		reader: flate.NewReader(bytes.NewReader(nil)),
+	}
+	if cf_impl.writer, err = flate.NewWriter(&cf_impl.buf, level); err != nil {
+		return cf, fmt.Errorf("new deflate writer fail, err=[%v] level=%d", err, level)
+	}
+	cf = cf_impl
+	return cf, err
+}
+
+// deflate
+func (self *compressFilter) onDataRecv(dn *dataBlock) (*dataBlock, error) {
+	atomic.AddInt64(&self.deflateIn, int64(len(dn.data)))
+	var frame []byte
+	if self.skip > 0 {
+		self.skip -= 1
+	} else if len(dn.data) >= compressMinSize {
+		self.buf.Reset()
+		self.writer.Reset(&self.buf)
+		if _, err := self.writer.Write(dn.data); err != nil {
+			return nil, fmt.Errorf("deflate fail, err=[%v]", err)
+		} else if err = self.writer.Close(); err != nil {
+			return nil, fmt.Errorf("deflate fail, err=[%v]", err)
+		}
+		if self.buf.Len() < len(dn.data) {
+			frame = appendCompressFrame(compressFrameDeflate, self.buf.Bytes())
+			self.skipNext = 0
+		} else {
+			self.skipNext = min(max(self.skipNext*2, 1), compressSkipMax)
+			self.skip = self.skipNext
+		}
+	}
+	if frame == nil {
+		frame = appendCompressFrame(compressFrameStored, dn.data)
+		atomic.AddInt64(&self.stored, 1)
+	}
+	atomic.AddInt64(&self.deflateOut, int64(len(frame)))
+	return &dataBlock{data: frame}, nil
+}
+
+func appendCompressFrame(frame_type byte, payload []byte) []byte {
+	frame := make([]byte, compressFrameHeaderSize, compressFrameHeaderSize+int64(len(payload)))
+	frame[0] = frame_type
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	return append(frame, payload...)
+}
+
+// stream decoding
+// inflate
+func (self *compressFilter) onDataSend(dn *dataBlock) (*dataBlock, error) {
+	self.pending = append(self.pending, dn.data...)
+	var plain []byte
+	for int64(len(self.pending)) >= compressFrameHeaderSize {
+		frame_type := self.pending[0]
+		frame_len := int64(binary.BigEndian.Uint32(self.pending[1:]))
+		if frame_len > DataBlockSize {
+			return nil, fmt.Errorf("invalid compress frame length, len=%d", frame_len)
+		}
+		if int64(len(self.pending)) < compressFrameHeaderSize+frame_len {
+			break
+		}
+		payload := self.pending[compressFrameHeaderSize : compressFrameHeaderSize+frame_len]
+		switch frame_type {
+		case compressFrameStored:
+			plain = append(plain, payload...)
+		case compressFrameDeflate:
+			data, err := self.inflate(payload)
+			if err != nil {
+				return nil, err
+			}
+			plain = append(plain, data...)
+		default:
+			return nil, fmt.Errorf("invalid compress frame type, type=%d", frame_type)
+		}
+		atomic.AddInt64(&self.inflateIn, compressFrameHeaderSize+frame_len)
+		self.pending = self.pending[compressFrameHeaderSize+frame_len:]
+	}
+	if len(self.pending) == 0 {
+		self.pending = nil
+	}
+	if len(plain) == 0 {
+		return nil, nil
+	}
+	atomic.AddInt64(&self.inflateOut, int64(len(plain)))
+	return &dataBlock{data: plain}, nil
+}
+
+// No block inflates beyond DataBlockSize, a larger one is not from a peer filter
+func (self *compressFilter) inflate(payload []byte) (data []byte, err error) {
+	if err = self.reader.(flate.Resetter).Reset(bytes.NewReader(payload), nil); err != nil {
+		return data, fmt.Errorf("inflate fail, err=[%v]", err)
+	}
+	if data, err = io.ReadAll(io.LimitReader(self.reader, DataBlockSize+1)); err != nil {
+		return data, fmt.Errorf("inflate fail, err=[%v]", err)
+	} else if int64(len(data)) > DataBlockSize {
+		return data, fmt.Errorf("inflated block too large, len=%d", len(data))
+	}
+	return data, err
+}
+
+func (self *compressFilter) dataBlockSize() int64 {
+	return DataBlockSize - compressFrameHeaderSize
+}
+
+func (self *compressFilter) String() string {
+	return fmt.Sprintf("compress=[level=%d deflate=%d/%d inflate=%d/%d ratio=%.2f stored=%d]",
+		self.level, atomic.LoadInt64(&self.deflateOut), atomic.LoadInt64(&self.deflateIn),
+		atomic.LoadInt64(&self.inflateIn), atomic.LoadInt64(&self.inflateOut), self.ratio(), atomic.LoadInt64(&self.stored))
+}
+
+// Compressed to raw bytes of both directions, 1 while nothing is compressed
+func (self *compressFilter) ratio() float64 {
+	raw := atomic.LoadInt64(&self.deflateIn) + atomic.LoadInt64(&self.inflateOut)
+	if raw == 0 {
+		return 1
+	}
+	return float64(atomic.LoadInt64(&self.deflateOut)+atomic.LoadInt64(&self.inflateIn)) / float64(raw)
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"testing"
+)
+
+func randomTestBlock(t *testing.T, size int) []byte {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("rand fail, err=[%v]", err)
+	}
+	return data
+}
+
+func TestCheckCompressLevel(t *testing.T) {
+	cases := []struct {
+		level int64
+		valid bool
+	}{
+		{-1, false},
+		{0, true},
+		{1, true},
+		{9, true},
+		{10, false},
+	}
+	for _, c := range cases {
+		if err := checkCompressLevel(c.level); (err == nil) != c.valid {
+			t.Fatalf("level=%d err=[%v] valid=%t", c.level, err, c.valid)
+		}
+	}
+}
+
+func TestCompressFilterRoundTrip(t *testing.T) {
+	text := bytes.Repeat([]byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n"), 80)
+	random := randomTestBlock(t, 4096)
+	cases := []struct {
+		name   string
+		level  int
+		blocks [][]byte
+		types  []byte
+	}{
+		{"small block stored", 6, [][]byte{[]byte("hello")}, []byte{compressFrameStored}},
+		{"text deflated", 1, [][]byte{text}, []byte{compressFrameDeflate}},
+		{"best compression", 9, [][]byte{text, text}, []byte{compressFrameDeflate, compressFrameDeflate}},
+		{"random block stored", 6, [][]byte{random}, []byte{compressFrameStored}},
+		{"block after random one stored untried", 6, [][]byte{random, text, text},
+			[]byte{compressFrameStored, compressFrameStored, compressFrameDeflate}},
+		{"largest block", 6, testBlocks(int(DataBlockSize - compressFrameHeaderSize)), []byte{compressFrameDeflate}},
+	}
+	for _, c := range cases {
+		frames := roundTripFilter(t, c.name, func() (iFilter, iFilter) {
+			deflater, err := newCompressFilter(c.level)
+			if err != nil {
+				t.Fatalf("%s: newCompressFilter fail, err=[%v]", c.name, err)
+			}
+			inflater, err := newCompressFilter(c.level)
+			if err != nil {
+				t.Fatalf("%s: newCompressFilter fail, err=[%v]", c.name, err)
+			}
+			return deflater, inflater
+		}, c.blocks)
+		for i, frame := range frames {
+			if frame[0] != c.types[i] {
+				t.Fatalf("%s: block=%d type=%d want=%d", c.name, i, frame[0], c.types[i])
+			}
+		}
+	}
+}
+
+func TestCompressFilterRejects(t *testing.T) {
+	deflate := func(data []byte) []byte {
+		var buf bytes.Buffer
+		w, _ := flate.NewWriter(&buf, flate.BestCompression)
+		w.Write(data)
+		w.Close()
+		return buf.Bytes()
+	}
+	too_long := appendCompressFrame(compressFrameStored, nil)
+	too_long[1] = 0xff
+	cases := []struct {
+		name string
+		wire []byte
+	}{
+		{"unknown frame type", appendCompressFrame(7, []byte("data"))},
+		{"length too long", too_long},
+		{"corrupt deflate", appendCompressFrame(compressFrameDeflate, []byte{0xff, 0xff, 0xff, 0xff})},
+		{"inflated block too large", appendCompressFrame(compressFrameDeflate, deflate(make([]byte, DataBlockSize+1)))},
+	}
+	for _, c := range cases {
+		inflater, err := newCompressFilter(6)
+		if err != nil {
+			t.Fatalf("%s: newCompressFilter fail, err=[%v]", c.name, err)
+		}
+		if _, err = inflater.onDataSend(&dataBlock{data: c.wire}); err == nil {
+			t.Fatalf("%s: invalid frame inflated", c.name)
+		}
+	}
+}
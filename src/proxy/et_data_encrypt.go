@@ -3,42 +3,120 @@ package proxy
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync/atomic"
 	log "third/seelog"
 )
 
+// Every block read from the tcp connection is sealed into one frame:
+//
+//	| frame length (4 bytes) | nonce (12 bytes) | ciphertext + gcm tag |
+//
+// The block sequence number is used as additional data, so dropped,
+// replayed or reordered frames fail authentication on the other side.
+const (
+	encryptFrameHeaderSize int64 = 4
+	encryptNonceSize       int64 = 12
+	encryptTagSize         int64 = 16
+	encryptFrameOverhead   int64 = encryptFrameHeaderSize + encryptNonceSize + encryptTagSize
+)
+
 type encryptFilter struct {
-	block cipher.Block
+	sealAEAD cipher.AEAD
+	openAEAD cipher.AEAD
+	sealSeq  uint64
+	openSeq  uint64
+	pending  []byte
 }
 
-func newEncryptFilter(key []byte) (ef *encryptFilter) {
+func newAEAD(key []byte) (aead cipher.AEAD, err error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		log.Warnf("NewCipher fail, err=[%s]", err.Error())
-	} else {
-		log.Infof("NewCipher success")
+	} else if aead, err = cipher.NewGCM(block); err != nil {
+		log.Warnf("NewGCM fail, err=[%s]", err.Error())
+	}
+	return aead, err
+}
+
+// seal_key encrypts data read from the local tcp connection,
+// open_key decrypts data to be written to it.
+func newEncryptFilter(seal_key []byte, open_key []byte) (ef *encryptFilter) {
+	var open_aead cipher.AEAD
+	seal_aead, err := newAEAD(seal_key)
+	if err == nil {
+		open_aead, err = newAEAD(open_key)
+	}
+	if err == nil {
+		log.Debugf("NewCipher success")
 		ef = &encryptFilter{
-			block: block,
+			sealAEAD: seal_aead,
+			openAEAD: open_aead,
 		}
 	}
 	return ef
 }
 
-//encrypt
-//base64
-//json
-//stream encoding
+// encrypt
+// stream encoding
 func (self *encryptFilter) onDataRecv(dn *dataBlock) (*dataBlock, error) {
-	return dn, nil
+	frame := make([]byte, encryptFrameHeaderSize+encryptNonceSize, int64(len(dn.data))+encryptFrameOverhead)
+	nonce := frame[encryptFrameHeaderSize:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("generate nonce fail, err=[%v]", err)
+	}
+	frame = self.sealAEAD.Seal(frame, nonce, dn.data, self.additionalData(self.sealSeq))
+	binary.BigEndian.PutUint32(frame, uint32(int64(len(frame))-encryptFrameHeaderSize))
+	atomic.AddUint64(&self.sealSeq, 1)
+	return &dataBlock{data: frame}, nil
 }
 
-//stream decoding
-//json
-//base64
-//decrypt
+// stream decoding
+// decrypt
 func (self *encryptFilter) onDataSend(dn *dataBlock) (*dataBlock, error) {
-	return dn, nil
+	self.pending = append(self.pending, dn.data...)
+	var plain []byte
+	for int64(len(self.pending)) >= encryptFrameHeaderSize {
+		frame_len := int64(binary.BigEndian.Uint32(self.pending))
+		if frame_len < encryptNonceSize+encryptTagSize ||
+			frame_len > DataBlockSize+encryptNonceSize+encryptTagSize {
+			return nil, fmt.Errorf("invalid encrypt frame length, len=%d seq=%d", frame_len, self.openSeq)
+		}
+		if int64(len(self.pending)) < encryptFrameHeaderSize+frame_len {
+			break
+		}
+		frame := self.pending[encryptFrameHeaderSize : encryptFrameHeaderSize+frame_len]
+		nonce := frame[:encryptNonceSize]
+		var err error
+		plain, err = self.openAEAD.Open(plain, nonce, frame[encryptNonceSize:], self.additionalData(self.openSeq))
+		if err != nil {
+			return nil, fmt.Errorf("decrypt frame fail, err=[%v] seq=%d", err, self.openSeq)
+		}
+		atomic.AddUint64(&self.openSeq, 1)
+		self.pending = self.pending[encryptFrameHeaderSize+frame_len:]
+	}
+	if len(self.pending) == 0 {
+		self.pending = nil
+	}
+	if len(plain) == 0 {
+		return nil, nil
+	}
+	return &dataBlock{data: plain}, nil
 }
 
 func (self *encryptFilter) dataBlockSize() int64 {
-	return DataBlockSize
+	return DataBlockSize - encryptFrameOverhead
+}
+
+func (self *encryptFilter) additionalData(seq uint64) []byte {
+	ad := make([]byte, 8)
+	binary.BigEndian.PutUint64(ad, seq)
+	return ad
+}
+
+func (self *encryptFilter) String() string {
+	return fmt.Sprintf("encrypt=[sealed=%d opened=%d]", atomic.LoadUint64(&self.sealSeq), atomic.LoadUint64(&self.openSeq))
 }
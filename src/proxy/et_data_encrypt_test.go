@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func newEncryptFilterPair(t *testing.T) (client *encryptFilter, server *encryptFilter) {
+	c2s := bytes.Repeat([]byte{1}, handshakeKeySize)
+	s2c := bytes.Repeat([]byte{2}, handshakeKeySize)
+	if client = newEncryptFilter(c2s, s2c); client == nil {
+		t.Fatalf("newEncryptFilter fail")
+	}
+	if server = newEncryptFilter(s2c, c2s); server == nil {
+		t.Fatalf("newEncryptFilter fail")
+	}
+	return client, server
+}
+
+func TestEncryptFilterRoundTrip(t *testing.T) {
+	cases := []struct {
+		name   string
+		blocks [][]byte
+	}{
+		{"one byte", testBlocks(1)},
+		{"largest block", testBlocks(int(DataBlockSize - encryptFrameOverhead))},
+		{"blocks of several sizes", testBlocks(10, 200, 3000)},
+	}
+	for _, c := range cases {
+		frames := roundTripFilter(t, c.name, func() (iFilter, iFilter) {
+			return newEncryptFilterPair(t)
+		}, c.blocks)
+		for i, frame := range frames {
+			if int64(len(frame)) != int64(len(c.blocks[i]))+encryptFrameOverhead {
+				t.Fatalf("%s: sealed size=%d want=%d", c.name, len(frame), int64(len(c.blocks[i]))+encryptFrameOverhead)
+			}
+		}
+	}
+}
+
+func TestEncryptFilterRejects(t *testing.T) {
+	cases := []struct {
+		name   string
+		tamper func(frames [][]byte) []byte
+	}{
+		{"flipped ciphertext", func(frames [][]byte) []byte {
+			frame := append([]byte{}, frames[0]...)
+			frame[len(frame)-1] ^= 1
+			return frame
+		}},
+		{"flipped nonce", func(frames [][]byte) []byte {
+			frame := append([]byte{}, frames[0]...)
+			frame[encryptFrameHeaderSize] ^= 1
+			return frame
+		}},
+		{"reordered frames", func(frames [][]byte) []byte {
+			return append(append([]byte{}, frames[1]...), frames[0]...)
+		}},
+		{"replayed frame", func(frames [][]byte) []byte {
+			return append(append([]byte{}, frames[0]...), frames[0]...)
+		}},
+		{"length too short", func(frames [][]byte) []byte {
+			frame := append([]byte{}, frames[0]...)
+			binary.BigEndian.PutUint32(frame, uint32(encryptNonceSize))
+			return frame
+		}},
+		{"length too long", func(frames [][]byte) []byte {
+			frame := append([]byte{}, frames[0]...)
+			binary.BigEndian.PutUint32(frame, uint32(DataBlockSize+encryptFrameOverhead))
+			return frame
+		}},
+	}
+	for _, c := range cases {
+		client, server := newEncryptFilterPair(t)
+		var frames [][]byte
+		for _, data := range []string{"first", "second"} {
+			sealed, err := client.onDataRecv(&dataBlock{data: []byte(data)})
+			if err != nil {
+				t.Fatalf("%s: seal fail, err=[%v]", c.name, err)
+			}
+			frames = append(frames, sealed.data)
+		}
+		if _, err := server.onDataSend(&dataBlock{data: c.tamper(frames)}); err == nil {
+			t.Fatalf("%s: tampered data opened", c.name)
+		}
+	}
+}
+
+func TestEncryptFilterWrongKey(t *testing.T) {
+	client, _ := newEncryptFilterPair(t)
+	other := newEncryptFilter(bytes.Repeat([]byte{3}, handshakeKeySize), bytes.Repeat([]byte{3}, handshakeKeySize))
+	sealed, err := client.onDataRecv(&dataBlock{data: []byte("secret")})
+	if err != nil {
+		t.Fatalf("seal fail, err=[%v]", err)
+	}
+	if _, err = other.onDataSend(sealed); err == nil {
+		t.Fatalf("opened with the wrong key")
+	}
+}
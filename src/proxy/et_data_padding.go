@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"sync/atomic"
+)
+
+// Every block read from the tcp connection gets random padding:
+//
+//	| data length (4 bytes) | padding length (2 bytes) | data | padding |
+//
+// Chained before encryption it hides the block sizes of the tcp payload.
+const (
+	paddingFrameHeaderSize int64 = 6
+	PaddingFilterMaxSize   int64 = 256
+)
+
+type paddingFilter struct {
+	pending []byte
+	padded  int64
+}
+
+func newPaddingFilter() (pf *paddingFilter) {
+	pf = &paddingFilter{}
+	return pf
+}
+
+func (self *paddingFilter) onDataRecv(dn *dataBlock) (*dataBlock, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(PaddingFilterMaxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("generate padding size fail, err=[%v]", err)
+	}
+	padding_len := n.Int64()
+	frame := make([]byte, paddingFrameHeaderSize+int64(len(dn.data))+padding_len)
+	binary.BigEndian.PutUint32(frame, uint32(len(dn.data)))
+	binary.BigEndian.PutUint16(frame[4:], uint16(padding_len))
+	copy(frame[paddingFrameHeaderSize:], dn.data)
+	if _, err = rand.Read(frame[paddingFrameHeaderSize+int64(len(dn.data)):]); err != nil {
+		return nil, fmt.Errorf("generate padding fail, err=[%v]", err)
+	}
+	atomic.AddInt64(&self.padded, padding_len)
+	return &dataBlock{data: frame}, nil
+}
+
+// stream decoding
+func (self *paddingFilter) onDataSend(dn *dataBlock) (*dataBlock, error) {
+	self.pending = append(self.pending, dn.data...)
+	var plain []byte
+	for int64(len(self.pending)) >= paddingFrameHeaderSize {
+		data_len := int64(binary.BigEndian.Uint32(self.pending))
+		padding_len := int64(binary.BigEndian.Uint16(self.pending[4:]))
+		if data_len > DataBlockSize {
+			return nil, fmt.Errorf("invalid padding frame length, len=%d", data_len)
+		}
+		frame_len := paddingFrameHeaderSize + data_len + padding_len
+		if int64(len(self.pending)) < frame_len {
+			break
+		}
+		plain = append(plain, self.pending[paddingFrameHeaderSize:paddingFrameHeaderSize+data_len]...)
+		self.pending = self.pending[frame_len:]
+	}
+	if len(self.pending) == 0 {
+		self.pending = nil
+	}
+	if len(plain) == 0 {
+		return nil, nil
+	}
+	return &dataBlock{data: plain}, nil
+}
+
+func (self *paddingFilter) dataBlockSize() int64 {
+	return DataBlockSize - paddingFrameHeaderSize - PaddingFilterMaxSize
+}
+
+func (self *paddingFilter) String() string {
+	return fmt.Sprintf("padding=[padded=%d]", atomic.LoadInt64(&self.padded))
+}
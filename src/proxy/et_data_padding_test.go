@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestPaddingFilterRoundTrip(t *testing.T) {
+	cases := []struct {
+		name   string
+		blocks [][]byte
+	}{
+		{"empty block", testBlocks(0)},
+		{"largest block", testBlocks(int(newPaddingFilter().dataBlockSize()))},
+		{"blocks of several sizes", testBlocks(1, 200, 3000)},
+	}
+	for _, c := range cases {
+		frames := roundTripFilter(t, c.name, func() (iFilter, iFilter) {
+			return newPaddingFilter(), newPaddingFilter()
+		}, c.blocks)
+		for i, frame := range frames {
+			padding_len := int64(len(frame)) - paddingFrameHeaderSize - int64(len(c.blocks[i]))
+			if padding_len < 0 || padding_len > PaddingFilterMaxSize ||
+				int64(binary.BigEndian.Uint16(frame[4:])) != padding_len {
+				t.Fatalf("%s: padded size=%d data=%d", c.name, len(frame), len(c.blocks[i]))
+			}
+		}
+	}
+}
+
+// The same block gets padding of other sizes, all equal out of 64 is 1 in 257^63 for a random size
+func TestPaddingFilterRandomized(t *testing.T) {
+	pf := newPaddingFilter()
+	sizes := make(map[int]bool)
+	for i := 0; i < 64; i++ {
+		dn, err := pf.onDataRecv(&dataBlock{data: []byte("data")})
+		if err != nil {
+			t.Fatalf("pad fail, err=[%v]", err)
+		}
+		sizes[len(dn.data)] = true
+	}
+	if len(sizes) < 2 {
+		t.Fatalf("padding size never varies, sizes=%v", sizes)
+	}
+}
+
+func TestPaddingFilterRejects(t *testing.T) {
+	frame := make([]byte, paddingFrameHeaderSize)
+	binary.BigEndian.PutUint32(frame, uint32(DataBlockSize+1))
+	if _, err := newPaddingFilter().onDataSend(&dataBlock{data: frame}); err == nil {
+		t.Fatalf("frame of data length=%d accepted", DataBlockSize+1)
+	}
+}
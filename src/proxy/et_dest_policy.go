@@ -0,0 +1,266 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A destination rule looks like <host>[:<ports>]
+//   host  cidr (10.0.0.0/8, [fd00::/8]), ip, hostname glob (*.example.com) or *
+//   ports single port (22), range (8000-9000) or *, default is any port
+// The destination is resolved before the policy is checked and the checked
+// ip is the one dialed, so dns rebinding can not get around the policy.
+// Deny rules win over allow rules, while allow rules exist anything not
+// allowed is denied. Loopback, link-local, multicast and cloud metadata
+// addresses are denied unless allowed by an ip or cidr rule inside them,
+// so allowing 0.0.0.0/0 does not open 127.0.0.1.
+
+type destRule struct {
+	text     string
+	network  *net.IPNet
+	glob     string
+	portLow  int
+	portHigh int
+}
+
+type iDestPolicy interface {
+	resolve(addr string) (tcp_addr *net.TCPAddr, err error)
+	String() string
+}
+
+type destPolicy struct {
+	allow []*destRule
+	deny  []*destRule
+}
+
+// Returned while the destination is refused by the policy, not while it just can not be resolved
+type destDeniedError struct {
+	addr   string
+	reason string
+}
+
+var internalNetworks = mustParseCIDRs(
+	"127.0.0.0/8",
+	"::1/128",
+	"0.0.0.0/8",
+	"::/128",
+	"169.254.0.0/16",
+	"fe80::/10",
+	"224.0.0.0/4",
+	"ff00::/8",
+	"100.100.100.200/32",
+	"fd00:ec2::254/128",
+)
+
+const (
+	DestResolveTimeoutSec int64 = 10
+)
+
+func mustParseCIDRs(cidrs ...string) (networks []*net.IPNet) {
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func (self *destDeniedError) Error() string {
+	return fmt.Sprintf("destination denied by policy, addr=[%s] reason=[%s]", self.addr, self.reason)
+}
+
+func newDestPolicy(allow []string, deny []string) (dp iDestPolicy, err error) {
+	dp_impl := &destPolicy{}
+	dp_impl.allow, err = parseDestRules(allow)
+	if err == nil {
+		dp_impl.deny, err = parseDestRules(deny)
+	}
+	if err == nil {
+		dp = dp_impl
+	}
+	return dp, err
+}
+
+func parseDestRules(texts []string) (rules []*destRule, err error) {
+	for _, text := range texts {
+		rule, tmp_err := parseDestRule(text)
+		if tmp_err != nil {
+			return nil, tmp_err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, err
+}
+
+func parseDestRule(text string) (rule *destRule, err error) {
+	host := strings.ToLower(strings.TrimSpace(text))
+	ports := "*"
+	if strings.HasPrefix(host, "[") {
+		end := strings.Index(host, "]")
+		if end < 0 {
+			return nil, fmt.Errorf("invalid destination rule, missing ']', rule=[%s]", text)
+		}
+		if rest := host[end+1:]; rest != "" {
+			if !strings.HasPrefix(rest, ":") {
+				return nil, fmt.Errorf("invalid destination rule, rule=[%s]", text)
+			}
+			ports = rest[1:]
+		}
+		host = host[1:end]
+	} else if strings.Count(host, ":") == 1 {
+		i := strings.LastIndex(host, ":")
+		host, ports = host[:i], host[i+1:]
+	}
+
+	rule = &destRule{
+		text:     text,
+		portLow:  0,
+		portHigh: 65535,
+	}
+	if host == "" {
+		return nil, fmt.Errorf("invalid destination rule, empty host, rule=[%s]", text)
+	} else if strings.Contains(host, "/") {
+		if _, rule.network, err = net.ParseCIDR(host); err != nil {
+			return nil, fmt.Errorf("invalid destination rule, err=[%v] rule=[%s]", err, text)
+		}
+	} else if ip := net.ParseIP(host); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		rule.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	} else if _, err = path.Match(host, ""); err != nil {
+		return nil, fmt.Errorf("invalid destination rule, err=[%v] rule=[%s]", err, text)
+	} else {
+		rule.glob = host
+	}
+
+	if ports != "*" {
+		low, high := ports, ports
+		if i := strings.Index(ports, "-"); i >= 0 {
+			low, high = ports[:i], ports[i+1:]
+		}
+		rule.portLow, err = strconv.Atoi(low)
+		if err == nil {
+			rule.portHigh, err = strconv.Atoi(high)
+		}
+		if err == nil && (rule.portLow < 0 || rule.portHigh > 65535 || rule.portLow > rule.portHigh) {
+			err = fmt.Errorf("port out of range")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid destination rule ports, err=[%v] rule=[%s]", err, text)
+		}
+	}
+	return rule, err
+}
+
+func (self *destRule) matchPort(port int) bool {
+	return self.portLow <= port && port <= self.portHigh
+}
+
+// Ip rules only match the resolved ip, glob rules only match the requested hostname
+func (self *destRule) match(host string, ip net.IP, port int) bool {
+	if !self.matchPort(port) {
+		return false
+	}
+	if self.network != nil {
+		return self.network.Contains(ip)
+	}
+	if self.glob == "*" {
+		return true
+	}
+	matched, _ := path.Match(self.glob, strings.ToLower(host))
+	return matched
+}
+
+func (self *destPolicy) check(host string, ip net.IP, port int) (reason string) {
+	for _, rule := range self.deny {
+		if rule.match(host, ip, port) {
+			return fmt.Sprintf("match deny rule %s", rule.text)
+		}
+	}
+	allowed := len(self.allow) == 0
+	for _, rule := range self.allow {
+		allowed = allowed || rule.match(host, ip, port)
+	}
+	if !allowed {
+		return "not match any allow rule"
+	}
+	for _, network := range internalNetworks {
+		if network.Contains(ip) && !self.allowInternal(ip, port, network) {
+			return fmt.Sprintf("internal address %s", ip.String())
+		}
+	}
+	return reason
+}
+
+func (self *destPolicy) allowInternal(ip net.IP, port int, internal *net.IPNet) bool {
+	internal_ones, _ := internal.Mask.Size()
+	for _, rule := range self.allow {
+		if rule.network == nil || !rule.matchPort(port) || !rule.network.Contains(ip) {
+			continue
+		}
+		if ones, _ := rule.network.Mask.Size(); ones >= internal_ones && internal.Contains(rule.network.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *destPolicy) resolve(addr string) (tcp_addr *net.TCPAddr, err error) {
+	var port int
+	host, port_str, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid destination, err=[%v] addr=[%s]", err, addr)
+	} else if port, err = strconv.Atoi(port_str); err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid destination port, addr=[%s]", addr)
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(DestResolveTimeoutSec)*time.Second)
+		defer cancel()
+		ip_addrs, tmp_err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if tmp_err != nil {
+			return nil, tmp_err
+		}
+		for _, ip_addr := range ip_addrs {
+			ips = append(ips, ip_addr.IP)
+		}
+	}
+
+	// Only the first allowed address is dialed
+	reason := ""
+	for _, ip := range ips {
+		if reason = self.check(host, ip, port); reason == "" {
+			tcp_addr = &net.TCPAddr{IP: ip, Port: port}
+			break
+		}
+	}
+	if tcp_addr == nil {
+		if reason == "" {
+			reason = "no address"
+		}
+		err = &destDeniedError{addr: addr, reason: reason}
+	}
+	return tcp_addr, err
+}
+
+func (self *destPolicy) String() string {
+	texts := func(rules []*destRule) (ret []string) {
+		for _, rule := range rules {
+			ret = append(ret, rule.text)
+		}
+		return ret
+	}
+	return fmt.Sprintf("allow=%v deny=%v", texts(self.allow), texts(self.deny))
+}
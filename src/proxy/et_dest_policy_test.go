@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseDestRule(t *testing.T) {
+	cases := []struct {
+		text      string
+		valid     bool
+		network   string
+		glob      string
+		port_low  int
+		port_high int
+	}{
+		{"10.0.0.0/8", true, "10.0.0.0/8", "", 0, 65535},
+		{"10.0.0.1:22", true, "10.0.0.1/32", "", 22, 22},
+		{"10.0.0.1:8000-9000", true, "10.0.0.1/32", "", 8000, 9000},
+		{"[fd00::/8]:443", true, "fd00::/8", "", 443, 443},
+		{"[::1]", true, "::1/128", "", 0, 65535},
+		{"fd00::1", true, "fd00::1/128", "", 0, 65535},
+		{"*.Example.com:*", true, "", "*.example.com", 0, 65535},
+		{"*", true, "", "*", 0, 65535},
+		{"", false, "", "", 0, 0},
+		{":22", false, "", "", 0, 0},
+		{"[::1", false, "", "", 0, 0},
+		{"[::1]22", false, "", "", 0, 0},
+		{"10.0.0.0/33", false, "", "", 0, 0},
+		{"host:http", false, "", "", 0, 0},
+		{"host:9000-8000", false, "", "", 0, 0},
+		{"host:70000", false, "", "", 0, 0},
+		{"[a-", false, "", "", 0, 0},
+	}
+	for _, c := range cases {
+		rule, err := parseDestRule(c.text)
+		if (err == nil) != c.valid {
+			t.Fatalf("rule=[%s] err=[%v] valid=%t", c.text, err, c.valid)
+		}
+		if !c.valid {
+			continue
+		}
+		network := ""
+		if rule.network != nil {
+			network = rule.network.String()
+		}
+		if network != c.network || rule.glob != c.glob || rule.portLow != c.port_low || rule.portHigh != c.port_high {
+			t.Fatalf("rule=[%s] network=[%s] glob=[%s] ports=%d-%d want network=[%s] glob=[%s] ports=%d-%d",
+				c.text, network, rule.glob, rule.portLow, rule.portHigh, c.network, c.glob, c.port_low, c.port_high)
+		}
+	}
+}
+
+func TestDestPolicyCheck(t *testing.T) {
+	cases := []struct {
+		name    string
+		allow   []string
+		deny    []string
+		host    string
+		ip      string
+		port    int
+		allowed bool
+	}{
+		{"no rule allows public", nil, nil, "", "8.8.8.8", 53, true},
+		{"no rule denies loopback", nil, nil, "", "127.0.0.1", 22, false},
+		{"no rule denies metadata", nil, nil, "", "169.254.169.254", 80, false},
+		{"no rule denies ipv6 loopback", nil, nil, "", "::1", 22, false},
+		{"cidr allows inside", []string{"10.0.0.0/8"}, nil, "", "10.1.2.3", 22, true},
+		{"cidr denies outside", []string{"10.0.0.0/8"}, nil, "", "11.1.2.3", 22, false},
+		{"port range allows", []string{"10.0.0.1:8000-9000"}, nil, "", "10.0.0.1", 8080, true},
+		{"port range denies", []string{"10.0.0.1:8000-9000"}, nil, "", "10.0.0.1", 22, false},
+		{"glob matches hostname", []string{"*.example.com:443"}, nil, "www.EXAMPLE.com", "1.2.3.4", 443, true},
+		{"glob does not match ip", []string{"*.example.com:443"}, nil, "", "1.2.3.4", 443, false},
+		{"deny wins over allow", []string{"10.0.0.0/8"}, []string{"10.0.0.5"}, "", "10.0.0.5", 22, false},
+		{"deny of one port", nil, []string{"*:25"}, "", "8.8.8.8", 25, false},
+		{"any address does not open loopback", []string{"0.0.0.0/0"}, nil, "", "127.0.0.1", 22, false},
+		{"star does not open loopback", []string{"*"}, nil, "localhost", "127.0.0.1", 22, false},
+		{"loopback ip opens loopback", []string{"127.0.0.1:22"}, nil, "", "127.0.0.1", 22, true},
+		{"loopback ip of other port", []string{"127.0.0.1:22"}, nil, "", "127.0.0.1", 23, false},
+		{"loopback cidr opens loopback", []string{"127.0.0.0/8"}, nil, "", "127.0.0.2", 80, true},
+	}
+	for _, c := range cases {
+		dp, err := newDestPolicy(c.allow, c.deny)
+		if err != nil {
+			t.Fatalf("%s: newDestPolicy fail, err=[%v]", c.name, err)
+		}
+		reason := dp.(*destPolicy).check(c.host, net.ParseIP(c.ip), c.port)
+		if (reason == "") != c.allowed {
+			t.Fatalf("%s: reason=[%s] allowed=%t", c.name, reason, c.allowed)
+		}
+	}
+}
+
+func TestDestPolicyResolve(t *testing.T) {
+	dp, err := newDestPolicy([]string{"10.0.0.0/8"}, nil)
+	if err != nil {
+		t.Fatalf("newDestPolicy fail, err=[%v]", err)
+	}
+	cases := []struct {
+		addr   string
+		dial   string
+		denied bool
+	}{
+		{"10.0.0.1:22", "10.0.0.1:22", false},
+		{"11.0.0.1:22", "", true},
+		{"10.0.0.1", "", false},
+		{"10.0.0.1:0", "", false},
+		{"10.0.0.1:65536", "", false},
+	}
+	for _, c := range cases {
+		tcp_addr, err := dp.resolve(c.addr)
+		_, denied := err.(*destDeniedError)
+		if denied != c.denied {
+			t.Fatalf("addr=[%s] err=[%v] denied=%t", c.addr, err, c.denied)
+		}
+		if c.dial == "" && err == nil {
+			t.Fatalf("addr=[%s] resolved to %s", c.addr, tcp_addr.String())
+		} else if c.dial != "" && (err != nil || tcp_addr.String() != c.dial) {
+			t.Fatalf("addr=[%s] err=[%v] want=[%s]", c.addr, err, c.dial)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+// Why the tunnel server refused a connect or a mux stream, FailureUnknown while the
+// server is older than FailureCodeVersion or the failure is none of the others
+const (
+	FailureUnknown            byte = 0
+	FailureDenied             byte = 1
+	FailureNetworkUnreachable byte = 2
+	FailureHostUnreachable    byte = 3
+	FailureConnectionRefused  byte = 4
+)
+
+// Body of a refused connect from FailureCodeVersion on, older servers answer the reason as text
+type connectRefusal struct {
+	Code   byte   `json:"c"`
+	Reason string `json:"m"`
+}
+
+// The tunnel server refused a session or a mux stream, status is the http status it answered with
+type sessionRefusedError struct {
+	status int
+	code   byte
+	reason string
+}
+
+func (self *sessionRefusedError) Error() string {
+	return fmt.Sprintf("refused by tunnel server, status=%d code=%d reason=[%s]", self.status, self.code, self.reason)
+}
+
+// Nil while body is no connectRefusal, an error page of a proxy carries keys of its own
+func parseConnectRefusal(body string) (refusal *connectRefusal) {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(body)))
+	decoder.DisallowUnknownFields()
+	refusal = &connectRefusal{}
+	if err := decoder.Decode(refusal); err != nil || decoder.More() {
+		return nil
+	}
+	return refusal
+}
+
+// body is a connectRefusal, or the reason as text from a server older than FailureCodeVersion
+func newSessionRefusedError(status int, body string) *sessionRefusedError {
+	refusal := parseConnectRefusal(body)
+	if refusal == nil {
+		return &sessionRefusedError{status: status, reason: body}
+	}
+	return &sessionRefusedError{status: status, code: refusal.Code, reason: refusal.Reason}
+}
+
+// Who refused a connect. A forwarding proxy that can not pass it on answers 5xx with a body of
+// its own, the tunnel server refuses a client of FailureCodeVersion with a connectRefusal.
+func connectFailedBy(err error, res *http.Response, body string, forwarded bool) string {
+	failed_by := failedBy(err, res)
+	if failed_by == FailedByServer && res != nil && forwarded &&
+		res.StatusCode >= http.StatusInternalServerError && parseConnectRefusal(body) == nil {
+		failed_by = FailedByProxy
+	}
+	return failed_by
+}
+
+// The failure code of an error of connect or listen, told from the type of the error, never from its text
+func failureCode(err error) byte {
+	var dest_denied *destDeniedError
+	var reverse_denied *reverseDeniedError
+	var dns_err *net.DNSError
+	var net_err net.Error
+	switch {
+	case errors.As(err, &dest_denied), errors.As(err, &reverse_denied):
+		return FailureDenied
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return FailureConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return FailureNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dns_err):
+		return FailureHostUnreachable
+	case errors.As(err, &net_err) && net_err.Timeout():
+		return FailureHostUnreachable
+	}
+	return FailureUnknown
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestFailureCode(t *testing.T) {
+	dial_err := func(errno syscall.Errno) error {
+		return fmt.Errorf("dial fail, err=[%w]", &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)})
+	}
+	cases := []struct {
+		name string
+		err  error
+		code byte
+	}{
+		{"dest denied", fmt.Errorf("resolve fail, err=[%w]", &destDeniedError{addr: "a", reason: "r"}), FailureDenied},
+		{"reverse denied", &reverseDeniedError{addr: "a", reason: "r"}, FailureDenied},
+		{"connection refused", dial_err(syscall.ECONNREFUSED), FailureConnectionRefused},
+		{"network unreachable", dial_err(syscall.ENETUNREACH), FailureNetworkUnreachable},
+		{"host unreachable", dial_err(syscall.EHOSTUNREACH), FailureHostUnreachable},
+		{"unknown host", &net.DNSError{Err: "no such host", Name: "x.invalid", IsNotFound: true}, FailureHostUnreachable},
+		{"dial timeout", &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}, FailureHostUnreachable},
+		{"text only", fmt.Errorf("connection refused"), FailureUnknown},
+		{"no error", nil, FailureUnknown},
+	}
+	for _, c := range cases {
+		if code := failureCode(c.err); code != c.code {
+			t.Fatalf("%s: code=%d want=%d err=[%v]", c.name, code, c.code, c.err)
+		}
+	}
+}
+
+func TestNewSessionRefusedError(t *testing.T) {
+	cases := []struct {
+		name   string
+		body   string
+		code   byte
+		reason string
+	}{
+		{"coded refusal", `{"c":4,"m":"dial fail"}`, FailureConnectionRefused, "dial fail"},
+		{"code only", `{"c":1}`, FailureDenied, ""},
+		{"text of old server", "dial fail, err=[connection refused]", FailureUnknown, "dial fail, err=[connection refused]"},
+		{"empty body", "", FailureUnknown, ""},
+	}
+	for _, c := range cases {
+		refused := newSessionRefusedError(http.StatusBadGateway, c.body)
+		if refused.status != http.StatusBadGateway || refused.code != c.code || refused.reason != c.reason {
+			t.Fatalf("%s: status=%d code=%d reason=[%s] want code=%d reason=[%s]",
+				c.name, refused.status, refused.code, refused.reason, c.code, c.reason)
+		}
+	}
+}
+
+func TestConnectFailedBy(t *testing.T) {
+	res := func(status int) *http.Response {
+		return &http.Response{StatusCode: status}
+	}
+	cases := []struct {
+		name      string
+		err       error
+		res       *http.Response
+		body      string
+		forwarded bool
+		failed_by string
+	}{
+		{"refused by server", nil, res(http.StatusBadGateway), `{"c":3,"m":"dial fail"}`, false, FailedByServer},
+		{"refused by server through proxy", nil, res(http.StatusBadGateway), `{"c":3,"m":"dial fail"}`, true, FailedByServer},
+		{"error page of proxy", nil, res(http.StatusBadGateway), "<html>Bad Gateway</html>", true, FailedByProxy},
+		{"json error page of proxy", nil, res(http.StatusServiceUnavailable), `{"error":"upstream down"}`, true, FailedByProxy},
+		{"text of old server", nil, res(http.StatusBadGateway), "dial fail", false, FailedByServer},
+		{"denied through proxy", nil, res(http.StatusForbidden), "denied", true, FailedByServer},
+		{"proxy auth", nil, res(http.StatusProxyAuthRequired), "", false, FailedByProxy},
+		{"proxy connect", &net.OpError{Op: "proxyconnect", Err: fmt.Errorf("refused")}, nil, "", false, FailedByProxy},
+		{"dial server", &net.OpError{Op: "dial", Err: fmt.Errorf("refused")}, nil, "", true, FailedByServer},
+	}
+	for _, c := range cases {
+		if failed_by := connectFailedBy(c.err, c.res, c.body, c.forwarded); failed_by != c.failed_by {
+			t.Fatalf("%s: failed_by=%s want=%s", c.name, failed_by, c.failed_by)
+		}
+	}
+}
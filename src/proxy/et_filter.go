@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"common"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	log "third/seelog"
+)
+
+// The filters of a session are named in the order applied to data sent, data
+// received passes them in reverse. Both ends must use the same chain: the
+// client declares its chain at connect and the server refuses a session whose
+// chain differs from its own. Ends without Filters fall back to encryption per
+// server.EncryptData and compression while both sides enable it.
+const (
+	FilterCompress = "compress"
+	FilterEncrypt  = "encrypt"
+	FilterPadding  = "padding"
+	FilterBase64   = "base64"
+
+	DefaultCompressLevel int64 = 6
+)
+
+type filterChain struct {
+	filters   []iFilter
+	blockSize int64
+}
+
+func checkFilterChain(filters []string) (err error) {
+	for i, name := range filters {
+		switch name {
+		case FilterCompress, FilterEncrypt, FilterPadding, FilterBase64:
+		default:
+			return fmt.Errorf("unknown filter, name=[%s]", name)
+		}
+		if slices.Contains(filters[:i], name) {
+			return fmt.Errorf("duplicate filter, name=[%s]", name)
+		}
+	}
+	return err
+}
+
+func hasFilter(filters []string, name string) bool {
+	return slices.Contains(filters, name)
+}
+
+func filterChainString(filters []string) string {
+	return strings.Join(filters, ",")
+}
+
+// The chain of a session whose client declares none, compression always comes first
+func legacyFilterChain(compress bool, encrypt bool) (filters []string) {
+	if compress {
+		filters = append(filters, FilterCompress)
+	}
+	if encrypt {
+		filters = append(filters, FilterEncrypt)
+	}
+	return filters
+}
+
+// A compress filter in a declared chain without CompressionLevel uses DefaultCompressLevel
+func compressLevel(level int64) int {
+	if level <= 0 {
+		level = DefaultCompressLevel
+	}
+	return int(level)
+}
+
+// The chain of a session on the server, a client without Filters gets its chain only while
+// it can be told by the encrypt and compress flags of the connect response
+func serverFilterChain(q url.Values) (filters []string, err error) {
+	c := common.G.Server
+	client_chain := q.Get(QK_FILTERS)
+	ask_compress := q.Get(QK_COMPRESS) != "" || hasFilter(strings.Split(client_chain, ","), FilterCompress)
+	if len(c.Filters) > 0 {
+		filters = c.Filters
+	} else {
+		filters = legacyFilterChain(ask_compress && c.CompressionLevel > 0, c.EncryptData)
+	}
+	if client_chain != "" {
+		if client_chain != filterChainString(filters) {
+			err = fmt.Errorf("filter chain mismatch, client=[%s] server=[%s]", client_chain, filterChainString(filters))
+		}
+	} else if !slices.Equal(filters, legacyFilterChain(ask_compress && hasFilter(filters, FilterCompress), hasFilter(filters, FilterEncrypt))) {
+		err = fmt.Errorf("filter chain needs a client declaring Filters, server=[%s]", filterChainString(filters))
+	}
+	return filters, err
+}
+
+// The chain answered must be the one declared, and the encrypt flag signed by the server must agree
+func clientFilterChain(filters []string, cr *connectResponse) (chain []string, err error) {
+	if len(filters) == 0 {
+		return legacyFilterChain(cr.Compress, cr.Encrypt), err
+	}
+	if !slices.Equal(filters, cr.Filters) || hasFilter(filters, FilterEncrypt) != cr.Encrypt {
+		err = fmt.Errorf("filter chain not accepted by server, client=[%s] server=[%s] encrypt=%t",
+			filterChainString(filters), filterChainString(cr.Filters), cr.Encrypt)
+	}
+	return filters, err
+}
+
+// Blocks read from the tcp connection never exceed the block size of the session
+func newSessionFilter(keys *sessionKeys, params *sessionParams) (dn_filter iFilter) {
+	filters := make([]iFilter, 0, len(params.filters))
+	for _, name := range params.filters {
+		switch name {
+		case FilterCompress:
+			cf, err := newCompressFilter(params.compressLevel)
+			if err != nil {
+				log.Warnf("newCompressFilter fail, err=[%v]", err)
+				return dn_filter
+			}
+			filters = append(filters, cf)
+		case FilterEncrypt:
+			ef := newEncryptFilter(keys.sealKey, keys.openKey)
+			if ef == nil {
+				return dn_filter
+			}
+			filters = append(filters, ef)
+		case FilterPadding:
+			filters = append(filters, newPaddingFilter())
+		case FilterBase64:
+			filters = append(filters, newBase64Filter())
+		default:
+			log.Warnf("unknown filter, name=[%s]", name)
+			return dn_filter
+		}
+	}
+	if len(filters) == 0 {
+		filters = append(filters, &dummyFilter{})
+	}
+	dn_filter = newFilterChain(params.blockSize, filters...)
+	return dn_filter
+}
+
+func newFilterChain(block_size int64, filters ...iFilter) (fc *filterChain) {
+	fc = &filterChain{
+		filters:   filters,
+		blockSize: block_size,
+	}
+	return fc
+}
+
+func (self *filterChain) onDataRecv(dn *dataBlock) (filtered_dn *dataBlock, err error) {
+	filtered_dn = dn
+	for _, filter := range self.filters {
+		if filtered_dn, err = filter.onDataRecv(filtered_dn); filtered_dn == nil || err != nil {
+			break
+		}
+	}
+	return filtered_dn, err
+}
+
+// A filter still waiting for the rest of a frame holds back the ones after it
+func (self *filterChain) onDataSend(dn *dataBlock) (filtered_dn *dataBlock, err error) {
+	filtered_dn = dn
+	for i := len(self.filters) - 1; i >= 0; i-- {
+		if filtered_dn, err = self.filters[i].onDataSend(filtered_dn); filtered_dn == nil || err != nil {
+			break
+		}
+	}
+	return filtered_dn, err
+}
+
+// Every filter adds its overhead to a block, the block read must leave room for all of them
+func (self *filterChain) dataBlockSize() int64 {
+	size := DataBlockSize
+	for _, filter := range self.filters {
+		size -= DataBlockSize - filter.dataBlockSize()
+	}
+	return min(size, self.blockSize)
+}
+
+func (self *filterChain) String() string {
+	s := make([]string, 0, len(self.filters))
+	for _, filter := range self.filters {
+		s = append(s, filter.String())
+	}
+	return strings.Join(s, " ")
+}
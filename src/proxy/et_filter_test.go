@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Blocks pass sender on their way to the wire and receiver on the way back. The wire
+// is fed to receiver at once, byte by byte and in pieces cutting across frames, each
+// time through a new pair. The frames of the first pass are returned.
+func roundTripFilter(t *testing.T, name string, new_pair func() (sender iFilter, receiver iFilter), blocks [][]byte) (frames [][]byte) {
+	var plain []byte
+	for _, data := range blocks {
+		plain = append(plain, data...)
+	}
+	for pass, chunk := range []int{0, 1, 7} {
+		sender, receiver := new_pair()
+		var wire []byte
+		for _, data := range blocks {
+			dn, err := sender.onDataRecv(&dataBlock{data: data})
+			if err != nil {
+				t.Fatalf("%s: filter fail, err=[%v]", name, err)
+			}
+			if int64(len(dn.data)) > DataBlockSize {
+				t.Fatalf("%s: filtered size=%d exceeds block size=%d", name, len(dn.data), DataBlockSize)
+			}
+			if pass == 0 {
+				frames = append(frames, dn.data)
+			}
+			wire = append(wire, dn.data...)
+		}
+		if chunk == 0 {
+			chunk = max(len(wire), 1)
+		}
+		var received []byte
+		for len(wire) > 0 {
+			n := min(chunk, len(wire))
+			dn, err := receiver.onDataSend(&dataBlock{data: wire[:n]})
+			if err != nil {
+				t.Fatalf("%s: unfilter fail, err=[%v] chunk=%d", name, err, chunk)
+			}
+			if dn != nil {
+				received = append(received, dn.data...)
+			}
+			wire = wire[n:]
+		}
+		if !bytes.Equal(received, plain) {
+			t.Fatalf("%s: received %d bytes differ from %d sent, chunk=%d", name, len(received), len(plain), chunk)
+		}
+	}
+	return frames
+}
+
+func testBlocks(sizes ...int) (blocks [][]byte) {
+	for i, size := range sizes {
+		blocks = append(blocks, bytes.Repeat([]byte{byte(i + 1)}, size))
+	}
+	return blocks
+}
+
+func TestCheckFilterChain(t *testing.T) {
+	cases := []struct {
+		filters []string
+		valid   bool
+	}{
+		{nil, true},
+		{[]string{FilterCompress, FilterPadding, FilterEncrypt, FilterBase64}, true},
+		{[]string{FilterBase64, FilterEncrypt}, true},
+		{[]string{FilterEncrypt, FilterEncrypt}, false},
+		{[]string{FilterCompress, "gzip"}, false},
+		{[]string{""}, false},
+	}
+	for _, c := range cases {
+		if err := checkFilterChain(c.filters); (err == nil) != c.valid {
+			t.Fatalf("filters=[%s] err=[%v] valid=%t", filterChainString(c.filters), err, c.valid)
+		}
+	}
+}
+
+// Data passes the chain of one end on its way to the tcp connection of the other
+func TestSessionFilterRoundTrip(t *testing.T) {
+	c2s := bytes.Repeat([]byte{1}, handshakeKeySize)
+	s2c := bytes.Repeat([]byte{2}, handshakeKeySize)
+	text := bytes.Repeat([]byte("0123456789abcdef"), int(DataBlockSize/16))
+	cases := []struct {
+		name    string
+		filters []string
+	}{
+		{"no filter", nil},
+		{"compress and encrypt", []string{FilterCompress, FilterEncrypt}},
+		{"padding before encrypt", []string{FilterPadding, FilterEncrypt}},
+		{"every filter", []string{FilterCompress, FilterPadding, FilterEncrypt, FilterBase64}},
+		{"base64 first", []string{FilterBase64, FilterCompress}},
+	}
+	for _, c := range cases {
+		params := &sessionParams{filters: c.filters, compressLevel: compressLevel(0), blockSize: DataBlockSize}
+		client := newSessionFilter(&sessionKeys{sealKey: c2s, openKey: s2c}, params)
+		server := newSessionFilter(&sessionKeys{sealKey: s2c, openKey: c2s}, params)
+		if client == nil || server == nil {
+			t.Fatalf("%s: newSessionFilter fail", c.name)
+		}
+		block_size := client.dataBlockSize()
+		if block_size <= 0 || block_size > DataBlockSize {
+			t.Fatalf("%s: block size=%d", c.name, block_size)
+		}
+		for _, data := range [][]byte{text[:block_size/2], []byte("x"), bytes.Repeat([]byte{7}, int(block_size))} {
+			dn, err := client.onDataRecv(&dataBlock{data: data})
+			if err != nil {
+				t.Fatalf("%s: filter fail, err=[%v]", c.name, err)
+			}
+			if int64(len(dn.data)) > DataBlockSize {
+				t.Fatalf("%s: filtered size=%d exceeds block size=%d", c.name, len(dn.data), DataBlockSize)
+			}
+			if dn, err = server.onDataSend(dn); err != nil {
+				t.Fatalf("%s: unfilter fail, err=[%v]", c.name, err)
+			}
+			if dn == nil || !bytes.Equal(dn.data, data) {
+				t.Fatalf("%s: block of %d bytes changed on the way", c.name, len(data))
+			}
+		}
+	}
+}
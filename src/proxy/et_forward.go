@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"common"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	log "third/seelog"
+)
+
+// A client runs the listener of the client section while it has a destination
+// or a proxy listen mode, and one listener per client.Forwards. A listener
+// failing to bind is reported by its status while the others keep running.
+// ADMIN_FORWARDS_PATH of the debug address prints the status of all of them,
+// bound is the address listened on, by the tunnel server for reverse mode.
+const (
+	ADMIN_FORWARDS_PATH string = "/admin/forwards"
+
+	ListenerStarting  = "starting"
+	ListenerListening = "listening"
+	ListenerFailed    = "failed"
+)
+
+type clientServerGroup struct {
+	servers []*clientServer
+}
+
+// Accepted connections are counted active until closed
+type trackedListener struct {
+	*net.TCPListener
+	clientServer *clientServer
+}
+
+type trackedConn struct {
+	*net.TCPConn
+	clientServer *clientServer
+	closeOnce    sync.Once
+}
+
+func NewClientServer(dest string) (cs iClientServer) {
+	c := common.Config().Client
+	group := &clientServerGroup{}
+	if dest != "" || common.ValueOrDefault(c.ListenMode, ListenModeForward) != ListenModeForward {
+		server, err := newClientServer(c.BindAddress, -1, dest)
+		if err != nil {
+			log.Errorf("newClientServer fail, err=[%v] bind=[%s]", err, c.BindAddress)
+			return cs
+		}
+		group.servers = append(group.servers, server)
+	}
+	for i := range c.Forwards {
+		f := &c.Forwards[i]
+		server, err := newClientServer(common.ValueOrDefault(f.Name, f.BindAddress), i, f.Dest)
+		if err != nil {
+			log.Errorf("newClientServer fail, err=[%v] forward=[%d] bind=[%s]", err, i, f.BindAddress)
+			return cs
+		}
+		group.servers = append(group.servers, server)
+	}
+	http.HandleFunc(ADMIN_FORWARDS_PATH, group.serveStatus)
+	cs = group
+	return cs
+}
+
+// Returns once every listener failed
+func (self *clientServerGroup) Start() {
+	var wg sync.WaitGroup
+	for _, server := range self.servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.Start()
+		}()
+	}
+	wg.Wait()
+}
+
+// A listener failing to reload keeps its old context, the others are reloaded still
+func (self *clientServerGroup) Reload() (err error) {
+	for _, server := range self.servers {
+		if reload_err := server.Reload(); reload_err != nil {
+			err = fmt.Errorf("reload fail, err=[%v] name=[%s]", reload_err, server.name)
+			log.Warnf("%v", err)
+		}
+	}
+	return err
+}
+
+func (self *clientServerGroup) serveStatus(w http.ResponseWriter, r *http.Request) {
+	for _, server := range self.servers {
+		fmt.Fprintf(w, "%s\n", server.String())
+	}
+}
+
+func (self *clientServer) setState(state string, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.state = state
+	if err != nil {
+		self.lastError = err.Error()
+	}
+}
+
+func (self *clientServer) setBound(bound string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.bound = bound
+}
+
+func (self *clientServer) tunnelFailed(err error) {
+	atomic.AddInt64(&self.failed, 1)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.lastError = err.Error()
+}
+
+// opened counts the failure before it is told
+func (self *clientServer) countFailure(opened func(err error) error) func(err error) error {
+	return func(err error) error {
+		if err != nil {
+			self.tunnelFailed(err)
+		}
+		return opened(err)
+	}
+}
+
+func (self *clientServer) String() string {
+	config := self.getContext().config
+	self.lock.RLock()
+	state, bound, last_error := self.state, self.bound, self.lastError
+	self.lock.RUnlock()
+	return fmt.Sprintf("name=[%s] mode=[%s] bind=[%s] bound=[%s] dest=[%s] server=[%s] state=[%s] accepted=%d active=%d failed=%d lastError=[%s]",
+		self.name, self.listenMode, self.bindAddress, bound, self.remoteAddress, config.ServerAddress, state,
+		atomic.LoadInt64(&self.accepted), atomic.LoadInt64(&self.active), atomic.LoadInt64(&self.failed), last_error)
+}
+
+func (self *trackedListener) Accept() (net.Conn, error) {
+	conn, err := self.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&self.clientServer.accepted, 1)
+	atomic.AddInt64(&self.clientServer.active, 1)
+	return &trackedConn{TCPConn: conn, clientServer: self.clientServer}, nil
+}
+
+func (self *trackedConn) Close() error {
+	self.closeOnce.Do(func() {
+		atomic.AddInt64(&self.clientServer.active, -1)
+	})
+	return self.TCPConn.Close()
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+)
+
+// The connect request carries an ephemeral x25519 public key of the client,
+// the server answers with its own ephemeral public key signed by the server
+// private key. Both sides derive the session keys from the ecdh secret, so
+// a leaked private key does not expose recorded sessions.
+const (
+	handshakeSignContext = "eTunnel handshake v1"
+	handshakeKeyC2S      = "eTunnel session key client to server"
+	handshakeKeyS2C      = "eTunnel session key server to client"
+	handshakeKeyMAC      = "eTunnel session request mac key"
+	sessionIdSize        = 16
+	handshakeKeySize     = 32
+)
+
+type sessionKeys struct {
+	encrypt bool
+	sealKey []byte
+	openKey []byte
+	macKey  []byte
+}
+
+type clientHandshake struct {
+	ephemeral *ecdh.PrivateKey
+}
+
+type connectResponse struct {
+	SessionId string   `json:"i"`
+	ServerKey string   `json:"k"`
+	Signature string   `json:"s"`
+	Encrypt   bool     `json:"e"`
+	Transport string   `json:"w,omitempty"`
+	Compress  bool     `json:"z,omitempty"`
+	Filters   []string `json:"f,omitempty"`
+	// absent while the server is older than version negotiation
+	Version      int                 `json:"v,omitempty"`
+	BlockSize    int64               `json:"b,omitempty"`
+	Capabilities *serverCapabilities `json:"x,omitempty"`
+	// address the server listens on for a reverse session
+	Reverse string `json:"r,omitempty"`
+}
+
+func newClientHandshake() (ch *clientHandshake, err error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err == nil {
+		ch = &clientHandshake{
+			ephemeral: ephemeral,
+		}
+	}
+	return ch, err
+}
+
+func (self *clientHandshake) request() string {
+	return base64.RawURLEncoding.EncodeToString(self.ephemeral.PublicKey().Bytes())
+}
+
+func (self *clientHandshake) finish(cr *connectResponse, server_key *rsa.PublicKey) (keys *sessionKeys, err error) {
+	var server_pub []byte
+	var signature []byte
+	var peer *ecdh.PublicKey
+	var secret []byte
+	client_pub := self.ephemeral.PublicKey().Bytes()
+	if server_pub, err = base64.RawURLEncoding.DecodeString(cr.ServerKey); err != nil {
+		err = fmt.Errorf("decode server key fail, err=[%v]", err)
+	} else if signature, err = base64.RawURLEncoding.DecodeString(cr.Signature); err != nil {
+		err = fmt.Errorf("decode signature fail, err=[%v]", err)
+	} else if err = rsa.VerifyPSS(server_key, crypto.SHA256, handshakeDigest(cr.SessionId, cr.Encrypt, client_pub, server_pub), signature, nil); err != nil {
+		err = fmt.Errorf("verify server signature fail, public key mismatch, err=[%v]", err)
+	} else if peer, err = ecdh.X25519().NewPublicKey(server_pub); err != nil {
+		err = fmt.Errorf("invalid server key, err=[%v]", err)
+	} else if secret, err = self.ephemeral.ECDH(peer); err != nil {
+		err = fmt.Errorf("ecdh fail, err=[%v]", err)
+	} else if c2s, s2c, mac, tmp_err := deriveSessionKeys(secret, client_pub, server_pub); tmp_err != nil {
+		err = tmp_err
+	} else {
+		keys = &sessionKeys{
+			encrypt: cr.Encrypt,
+			sealKey: c2s,
+			openKey: s2c,
+			macKey:  mac,
+		}
+	}
+	return keys, err
+}
+
+func serverHandshake(conn_key string, request string, encrypt bool, server_key *rsa.PrivateKey) (cr *connectResponse, keys *sessionKeys, err error) {
+	var client_pub []byte
+	var peer *ecdh.PublicKey
+	var ephemeral *ecdh.PrivateKey
+	var secret []byte
+	if client_pub, err = base64.RawURLEncoding.DecodeString(request); err != nil {
+		err = fmt.Errorf("decode client key fail, err=[%v]", err)
+	} else if peer, err = ecdh.X25519().NewPublicKey(client_pub); err != nil {
+		err = fmt.Errorf("invalid client key, err=[%v]", err)
+	} else if ephemeral, err = ecdh.X25519().GenerateKey(rand.Reader); err != nil {
+		err = fmt.Errorf("generate ephemeral key fail, err=[%v]", err)
+	} else if secret, err = ephemeral.ECDH(peer); err != nil {
+		err = fmt.Errorf("ecdh fail, err=[%v]", err)
+	}
+	if err != nil {
+		return cr, keys, err
+	}
+
+	var signature []byte
+	server_pub := ephemeral.PublicKey().Bytes()
+	digest := handshakeDigest(conn_key, encrypt, client_pub, server_pub)
+	if signature, err = rsa.SignPSS(rand.Reader, server_key, crypto.SHA256, digest, nil); err != nil {
+		err = fmt.Errorf("sign handshake fail, err=[%v]", err)
+	} else if c2s, s2c, mac, tmp_err := deriveSessionKeys(secret, client_pub, server_pub); tmp_err != nil {
+		err = tmp_err
+	} else {
+		keys = &sessionKeys{
+			encrypt: encrypt,
+			sealKey: s2c,
+			openKey: c2s,
+			macKey:  mac,
+		}
+		cr = &connectResponse{
+			SessionId: conn_key,
+			ServerKey: base64.RawURLEncoding.EncodeToString(server_pub),
+			Signature: base64.RawURLEncoding.EncodeToString(signature),
+			Encrypt:   encrypt,
+		}
+	}
+	return cr, keys, err
+}
+
+func handshakeDigest(conn_key string, encrypt bool, client_pub []byte, server_pub []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(handshakeSignContext))
+	h.Write([]byte{0})
+	h.Write([]byte(conn_key))
+	h.Write([]byte{0})
+	if encrypt {
+		h.Write([]byte{1})
+	} else {
+		h.Write([]byte{0})
+	}
+	h.Write(client_pub)
+	h.Write(server_pub)
+	return h.Sum(nil)
+}
+
+func deriveSessionKeys(secret []byte, client_pub []byte, server_pub []byte) (c2s []byte, s2c []byte, mac []byte, err error) {
+	salt := append(append([]byte{}, client_pub...), server_pub...)
+	if c2s, err = hkdf.Key(sha256.New, secret, salt, handshakeKeyC2S, handshakeKeySize); err != nil {
+		err = fmt.Errorf("derive session key fail, err=[%v]", err)
+	} else if s2c, err = hkdf.Key(sha256.New, secret, salt, handshakeKeyS2C, handshakeKeySize); err != nil {
+		err = fmt.Errorf("derive session key fail, err=[%v]", err)
+	} else if mac, err = hkdf.Key(sha256.New, secret, salt, handshakeKeyMAC, handshakeKeySize); err != nil {
+		err = fmt.Errorf("derive session key fail, err=[%v]", err)
+	}
+	return c2s, s2c, mac, err
+}
+
+// Session ids are issued by the server, they are unpredictable and never reused
+func newSessionId() (id string, err error) {
+	b := make([]byte, sessionIdSize)
+	if _, err = rand.Read(b); err == nil {
+		id = base64.RawURLEncoding.EncodeToString(b)
+	}
+	return id, err
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"testing"
+)
+
+func generateTestKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey fail, err=[%v]", err)
+	}
+	return key
+}
+
+func TestHandshakeKeys(t *testing.T) {
+	server_key := generateTestKey(t)
+	for _, encrypt := range []bool{true, false} {
+		ch, err := newClientHandshake()
+		if err != nil {
+			t.Fatalf("newClientHandshake fail, err=[%v]", err)
+		}
+		cr, server_keys, err := serverHandshake("session", ch.request(), encrypt, server_key)
+		if err != nil {
+			t.Fatalf("serverHandshake fail, err=[%v] encrypt=%t", err, encrypt)
+		}
+		client_keys, err := ch.finish(cr, &server_key.PublicKey)
+		if err != nil {
+			t.Fatalf("finish fail, err=[%v] encrypt=%t", err, encrypt)
+		}
+		if client_keys.encrypt != encrypt || server_keys.encrypt != encrypt {
+			t.Fatalf("encrypt=%t/%t want=%t", client_keys.encrypt, server_keys.encrypt, encrypt)
+		}
+		if !bytes.Equal(client_keys.sealKey, server_keys.openKey) || !bytes.Equal(client_keys.openKey, server_keys.sealKey) {
+			t.Fatalf("session keys of both ends differ, encrypt=%t", encrypt)
+		}
+		if !bytes.Equal(client_keys.macKey, server_keys.macKey) {
+			t.Fatalf("mac keys of both ends differ, encrypt=%t", encrypt)
+		}
+		if bytes.Equal(client_keys.sealKey, client_keys.openKey) || bytes.Equal(client_keys.sealKey, client_keys.macKey) {
+			t.Fatalf("keys of both directions and the mac key must differ, encrypt=%t", encrypt)
+		}
+	}
+}
+
+func TestHandshakeRejects(t *testing.T) {
+	server_key := generateTestKey(t)
+	other_key := generateTestKey(t)
+	flip := func(s string) string {
+		b, _ := base64.RawURLEncoding.DecodeString(s)
+		b[0] ^= 1
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	cases := []struct {
+		name   string
+		key    *rsa.PublicKey
+		tamper func(cr *connectResponse)
+	}{
+		{"other server key", &other_key.PublicKey, func(cr *connectResponse) {}},
+		{"session id changed", &server_key.PublicKey, func(cr *connectResponse) { cr.SessionId = "other" }},
+		{"encrypt turned off", &server_key.PublicKey, func(cr *connectResponse) { cr.Encrypt = false }},
+		{"ephemeral key replaced", &server_key.PublicKey, func(cr *connectResponse) { cr.ServerKey = flip(cr.ServerKey) }},
+		{"signature flipped", &server_key.PublicKey, func(cr *connectResponse) { cr.Signature = flip(cr.Signature) }},
+		{"signature not base64", &server_key.PublicKey, func(cr *connectResponse) { cr.Signature = "!" }},
+		{"ephemeral key not base64", &server_key.PublicKey, func(cr *connectResponse) { cr.ServerKey = "!" }},
+	}
+	for _, c := range cases {
+		ch, err := newClientHandshake()
+		if err != nil {
+			t.Fatalf("newClientHandshake fail, err=[%v]", err)
+		}
+		cr, _, err := serverHandshake("session", ch.request(), true, server_key)
+		if err != nil {
+			t.Fatalf("%s: serverHandshake fail, err=[%v]", c.name, err)
+		}
+		c.tamper(cr)
+		if _, err = ch.finish(cr, c.key); err == nil {
+			t.Fatalf("%s: handshake accepted", c.name)
+		}
+	}
+}
+
+func TestServerHandshakeInvalidRequest(t *testing.T) {
+	server_key := generateTestKey(t)
+	cases := []struct {
+		name    string
+		request string
+	}{
+		{"empty", ""},
+		{"not base64", "!!!"},
+		{"short key", base64.RawURLEncoding.EncodeToString([]byte("short"))},
+	}
+	for _, c := range cases {
+		if _, _, err := serverHandshake("session", c.request, true, server_key); err == nil {
+			t.Fatalf("%s: request accepted", c.name)
+		}
+	}
+}
+
+func TestDeriveSessionKeys(t *testing.T) {
+	secret := bytes.Repeat([]byte{7}, 32)
+	client_pub := bytes.Repeat([]byte{1}, 32)
+	server_pub := bytes.Repeat([]byte{2}, 32)
+	c2s, s2c, mac, err := deriveSessionKeys(secret, client_pub, server_pub)
+	if err != nil {
+		t.Fatalf("deriveSessionKeys fail, err=[%v]", err)
+	}
+	cases := []struct {
+		name       string
+		secret     []byte
+		client_pub []byte
+		server_pub []byte
+		same       bool
+	}{
+		{"same input", secret, client_pub, server_pub, true},
+		{"other secret", bytes.Repeat([]byte{8}, 32), client_pub, server_pub, false},
+		{"other client key", secret, server_pub, server_pub, false},
+		{"swapped keys", secret, server_pub, client_pub, false},
+	}
+	for _, c := range cases {
+		c2s_again, s2c_again, mac_again, err := deriveSessionKeys(c.secret, c.client_pub, c.server_pub)
+		if err != nil {
+			t.Fatalf("%s: deriveSessionKeys fail, err=[%v]", c.name, err)
+		}
+		for _, k := range [][]byte{c2s_again, s2c_again, mac_again} {
+			if len(k) != handshakeKeySize {
+				t.Fatalf("%s: key size=%d want=%d", c.name, len(k), handshakeKeySize)
+			}
+		}
+		same := bytes.Equal(c2s, c2s_again) && bytes.Equal(s2c, s2c_again) && bytes.Equal(mac, mac_again)
+		if same != c.same {
+			t.Fatalf("%s: same=%t want=%t", c.name, same, c.same)
+		}
+	}
+}
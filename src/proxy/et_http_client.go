@@ -3,12 +3,20 @@ package proxy
 import (
 	"bytes"
 	"common"
+	"crypto/rsa"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	log "third/seelog"
+	"time"
 )
 
 type iHTTPClient interface {
@@ -16,50 +24,253 @@ type iHTTPClient interface {
 	isAlive() bool
 	pushTCPRequest(dn *dataBlock)
 	popTCPResponse() (dn *dataBlock)
+	sessionKeys() *sessionKeys
+	sessionParams() *sessionParams
 	String() string
 }
 
+// Shared by all sessions to the same tunnel server
+type clientContext struct {
+	config     *common.ClientConfig
+	scheme     string
+	host       string
+	serverKey  *rsa.PublicKey
+	authId     string
+	authSecret []byte
+	wire       *wireFormat
+	hc         *http.Client
+	// proxy of the requests to the server, nil while they go straight
+	proxy func(*http.Request) (*url.URL, error)
+	// method of data requests, and where their payload goes: body, query or header
+	uploadMethod   string
+	uploadEncoding string
+	// http2 only, carries the stream of sessions using the h2 or h2c transport
+	streamHC  *http.Client
+	transport string
+	// the stream transport is not tried again before this time after it failed
+	streamRetryAfter int64
+	// declared filter chain, empty leaves it to the server
+	filters   []string
+	blockSize int64
+	// credential asked from the clients of the listener, empty asks for none
+	listenUser     string
+	listenPassword string
+}
+
 type httpClient struct {
-	hc        *http.Client
-	host      string
+	ctx       *clientContext
 	dest      string
 	seq       int64
-	connKey   int64
+	ack       int64
+	retry     int64
+	connKey   string
+	keys      *sessionKeys
 	sendQ     chan *dataBlock
 	sendQsync chan *dataBlock
 	sendNop   chan *dataBlock
-	respQ     chan *http.Response
+	inflight  chan bool
+	respQ     chan *pendingResponse
 	recvQ     chan *dataBlock
-	alive     bool
+	params    *sessionParams
+	stream    iStreamConn
+	alive     int32
+}
+
+// Queued in seq order when the request is sent, so responses are read in order
+// whatever order they complete in
+type pendingResponse struct {
+	seq      int64
+	url      string
+	body     []byte
+	attempts int64
+	res      chan *http.Response
+}
+
+const (
+	DefaultRetryCount int64 = 5
+	RetryBackoffMinMs int64 = 200
+	RetryBackoffMaxMs int64 = 5000
+
+	// Payload encoded into the query or a header is cut to this size per request,
+	// so the request line and headers stay within what proxies accept
+	EncodedPayloadMaxSize int = 4096
+
+	UploadGet       = "GET"
+	UploadPost      = "POST"
+	UploadPut       = "PUT"
+	UploadGetQuery  = "GET-QUERY"
+	UploadGetHeader = "GET-HEADER"
+
+	uploadEncodingBody   = "body"
+	uploadEncodingQuery  = "query"
+	uploadEncodingHeader = "header"
+)
+
+// c is the listener the sessions of the context serve
+func newClientContext(c *common.ClientConfig) (ctx *clientContext, err error) {
+	var server_key *rsa.PublicKey
+	var tls_config *tls.Config
+	var wire *wireFormat
+	var upload_method, upload_encoding string
+	var block_size int64
+	var proxy func(*http.Request) (*url.URL, error)
+	transport := common.ValueOrDefault(c.Transport, TransportPoll)
+	if err = checkTransport(transport, c.TLSEnable); err != nil {
+		err = fmt.Errorf("checkTransport fail, err=[%v]", err)
+	} else if upload_method, upload_encoding, err = parseUploadMethod(c.UploadMethod); err != nil {
+		err = fmt.Errorf("parseUploadMethod fail, err=[%v]", err)
+	} else if err = checkCompressLevel(c.CompressionLevel); err != nil {
+		err = fmt.Errorf("checkCompressLevel fail, err=[%v]", err)
+	} else if err = checkFilterChain(c.Filters); err != nil {
+		err = fmt.Errorf("checkFilterChain fail, err=[%v]", err)
+	} else if block_size, err = checkBlockSize(c.MaxBlockSize); err != nil {
+		err = fmt.Errorf("checkBlockSize fail, err=[%v]", err)
+	} else if proxy, err = newClientProxy(c); err != nil {
+		err = fmt.Errorf("newClientProxy fail, err=[%v]", err)
+	} else if server_key, err = common.LoadPublicKey(c.PublicKeyFilePath); err != nil {
+		err = fmt.Errorf("load public key fail, err=[%v] path=[%s]", err, c.PublicKeyFilePath)
+	} else if tls_config, err = newClientTLSConfig(c); err != nil {
+		err = fmt.Errorf("newClientTLSConfig fail, err=[%v]", err)
+	} else if wire, err = newWireFormat(); err != nil {
+		err = fmt.Errorf("newWireFormat fail, err=[%v]", err)
+	} else {
+		log.Infof("load public key succ, fingerprint=[%s] path=[%s]",
+			common.KeyFingerprint(server_key), c.PublicKeyFilePath)
+		http_transport := &http.Transport{
+			Proxy:                  proxy,
+			OnProxyConnectResponse: onProxyConnectResponse,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSClientConfig:     tls_config,
+			TLSHandshakeTimeout: 10 * time.Second,
+			MaxIdleConnsPerHost: int(DataQueueSize),
+		}
+		ctx = &clientContext{
+			scheme:     "http",
+			host:       c.ServerAddress,
+			config:     c,
+			serverKey:  server_key,
+			authId:     c.AuthId,
+			authSecret: []byte(c.AuthSecret),
+			wire:       wire,
+			hc:         &http.Client{Transport: http_transport},
+			proxy:      proxy,
+			transport:  transport,
+			filters:    c.Filters,
+			blockSize:  block_size,
+
+			listenUser:     c.ListenUser,
+			listenPassword: c.ListenPassword,
+
+			uploadMethod:   upload_method,
+			uploadEncoding: upload_encoding,
+		}
+		if c.TLSEnable {
+			ctx.scheme = "https"
+		}
+		if transport == TransportHTTP2 || transport == TransportHTTP2Cleartext {
+			stream_transport := http_transport.Clone()
+			stream_transport.Protocols = &http.Protocols{}
+			stream_transport.Protocols.SetHTTP2(transport == TransportHTTP2)
+			stream_transport.Protocols.SetUnencryptedHTTP2(transport == TransportHTTP2Cleartext)
+			ctx.streamHC = &http.Client{Transport: stream_transport}
+		}
+	}
+	return ctx, err
 }
 
-func newHTTPClient(host string, dest string) (hc iHTTPClient) {
+func parseUploadMethod(upload string) (method string, encoding string, err error) {
+	switch strings.ToUpper(common.ValueOrDefault(upload, UploadGet)) {
+	case UploadGet:
+		method, encoding = http.MethodGet, uploadEncodingBody
+	case UploadPost:
+		method, encoding = http.MethodPost, uploadEncodingBody
+	case UploadPut:
+		method, encoding = http.MethodPut, uploadEncodingBody
+	case UploadGetQuery:
+		method, encoding = http.MethodGet, uploadEncodingQuery
+	case UploadGetHeader:
+		method, encoding = http.MethodGet, uploadEncodingHeader
+	default:
+		err = fmt.Errorf("invalid upload method, method=[%s]", upload)
+	}
+	return method, encoding, err
+}
+
+func checkTransport(transport string, tls_enable bool) (err error) {
+	switch transport {
+	case TransportPoll, TransportWebSocket, TransportSplit:
+	case TransportHTTP2:
+		if !tls_enable {
+			err = fmt.Errorf("h2 needs TLSEnable, use h2c for cleartext")
+		}
+	case TransportHTTP2Cleartext:
+		if tls_enable {
+			err = fmt.Errorf("h2c is cleartext, use h2 while TLSEnable is set")
+		}
+	default:
+		err = fmt.Errorf("invalid transport, transport=[%s]", transport)
+	}
+	return err
+}
+
+// A multiplexed session has no dest, its streams carry their own destinations, but a
+// reverse session whose dest is the address the tunnel server is asked to listen on.
+// err is a *sessionRefusedError while the tunnel server refused the session.
+func newHTTPClient(ctx *clientContext, dest string, mux bool) (hc iHTTPClient, err error) {
 	hc_impl := &httpClient{
-		hc:        &http.Client{},
-		host:      host,
+		ctx:       ctx,
 		dest:      dest,
 		seq:       0,
-		connKey:   common.GetCurrentTime(),
+		retry:     ctx.config.RetryCount,
 		sendQ:     make(chan *dataBlock, DataQueueSize),
 		sendQsync: make(chan *dataBlock, 1),
 		sendNop:   make(chan *dataBlock, 1),
 		recvQ:     make(chan *dataBlock, DataQueueSize),
-		respQ:     make(chan *http.Response, DataQueueSize),
-		alive:     true,
+		inflight:  make(chan bool, pipelineWindow(ctx.config.PipelineWindow, DefaultClientPipelineWindow)),
+		respQ:     make(chan *pendingResponse, DataQueueSize),
+		params: &sessionParams{
+			transport: TransportPoll,
+			mux:       mux,
+		},
+		alive: 1,
 	}
-	if err := hc_impl.createConnection(); err != nil {
+	if hc_impl.retry <= 0 {
+		hc_impl.retry = DefaultRetryCount
+	}
+	if err = hc_impl.createConnection(); err != nil {
 		hc_impl.destroy()
+	} else if hc_impl.params.transport != TransportPoll && hc_impl.openStream() {
+		go hc_impl.streamSendLoop()
+		go hc_impl.streamRecvLoop()
+		hc = hc_impl
 	} else {
 		go hc_impl.processLoop()
 		go hc_impl.recvLoop()
 		hc = hc_impl
 	}
-	return hc
+	return hc, err
+}
+
+// The stream transport to ask the server for at connect, empty for long polling
+func (self *clientContext) streamTransport() string {
+	if self.transport == TransportPoll || common.GetCurrentTime() < atomic.LoadInt64(&self.streamRetryAfter) {
+		return ""
+	} else if self.transport == TransportHTTP2Cleartext {
+		return TransportHTTP2
+	}
+	return self.transport
+}
+
+func (self *clientContext) blockStream() {
+	atomic.StoreInt64(&self.streamRetryAfter, common.GetCurrentTime()+StreamRetryAfterSec*1000000)
 }
 
 func (self *httpClient) destroy() {
 	log.Infof("%s", self.String())
-	self.alive = false
+	atomic.StoreInt32(&self.alive, 0)
 	close(self.sendQsync)
 	self.recvQ <- nil
 }
@@ -81,13 +292,22 @@ func (self *httpClient) popTCPResponse() (dn *dataBlock) {
 	return dn
 }
 
+func (self *httpClient) sessionKeys() *sessionKeys {
+	return self.keys
+}
+
+func (self *httpClient) sessionParams() *sessionParams {
+	return self.params
+}
+
+// Still alive while received data is not taken, the last bytes before a close are not lost
 func (self *httpClient) isAlive() bool {
-	return self.alive
+	return atomic.LoadInt32(&self.alive) != 0 || 0 != len(self.recvQ)
 }
 
 func (self *httpClient) processLoop() {
 	self.sendNop <- nil
-	for self.isAlive() {
+	for atomic.LoadInt32(&self.alive) != 0 {
 		select {
 		case dn := <-self.sendQ:
 			if dn == nil {
@@ -106,90 +326,318 @@ func (self *httpClient) processLoop() {
 }
 
 func (self *httpClient) createConnection() (err error) {
+	handshake, err := newClientHandshake()
+	if err != nil {
+		log.Warnf("newClientHandshake fail, err=[%v]", err)
+		atomic.StoreInt32(&self.alive, 0)
+		return err
+	}
+
 	u := url.URL{
-		Scheme: "http",
-		Host:   self.host,
+		Scheme: self.ctx.scheme,
+		Host:   self.ctx.host,
 		Path:   QP_CONNECT,
 	}
 	q := u.Query()
-	q.Set(QK_CONN_KEY, strconv.FormatInt(self.connKey, 10))
-	q.Set(QK_ADDR, self.dest)
+	q.Set(QK_VERSION, strconv.Itoa(ProtocolVersion))
+	q.Set(QK_MAX_BLOCK, strconv.FormatInt(self.ctx.blockSize, 10))
+	if self.params.mux {
+		q.Set(QK_MUX, "1")
+		if self.dest != "" {
+			q.Set(QK_REVERSE, self.dest)
+		}
+	} else {
+		q.Set(QK_ADDR, self.dest)
+	}
+	if transport := self.ctx.streamTransport(); transport != "" {
+		q.Set(QK_TRANSPORT, transport)
+	}
+	if len(self.ctx.filters) > 0 {
+		q.Set(QK_FILTERS, filterChainString(self.ctx.filters))
+	} else if self.ctx.config.CompressionLevel > 0 {
+		q.Set(QK_COMPRESS, "1")
+	}
+	q.Set(QK_HANDSHAKE, handshake.request())
 	u.RawQuery = q.Encode()
+	signRequest(self.ctx.authId, self.ctx.authSecret, http.MethodGet, &u)
+	self.ctx.wire.encodeURL(&u)
 
 	log.Debugf("create connection to url=[%s]", u.String())
 	req, _ := http.NewRequest(http.MethodGet, u.String(), nil)
-	res, err := self.hc.Do(req)
+	self.ctx.wire.setRequestHeaders(req, false)
+	res, err := self.ctx.hc.Do(req)
 	if nil != err ||
 		http.StatusOK != res.StatusCode {
 		status := ""
+		msg := ""
 		if res != nil {
 			status = res.Status
+			body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+			msg = string(body)
+		}
+		failed_by := connectFailedBy(err, res, msg, forwardedByProxy(self.ctx.proxy, req))
+		log.Warnf("create connection fail at %s, err=[%v] status=[%s] msg=[%s] dest=[%s]", failed_by, err, status, msg, self.dest)
+		if res != nil && failed_by == FailedByServer {
+			err = newSessionRefusedError(res.StatusCode, msg)
+		} else {
+			err = fmt.Errorf("create connection fail at %s, err=[%v] status=[%s] msg=[%s]", failed_by, err, status, msg)
 		}
-		log.Warnf("create connection, err=[%v] status=[%s]", err, status)
-		err = fmt.Errorf("create connection fail, err=[%v] status=[%s]", err, status)
-		self.alive = false
+		atomic.StoreInt32(&self.alive, 0)
+	} else if self.keys, err = self.finishHandshake(handshake, res); err != nil {
+		log.Warnf("connection handshake fail, err=[%v] %s", err, self.String())
+		err = fmt.Errorf("connection handshake fail, err=[%v]", err)
+		atomic.StoreInt32(&self.alive, 0)
 	} else {
 		log.Infof("create connection success, %s", self.String())
+		if len(self.ctx.filters) == 0 && self.ctx.config.CompressionLevel > 0 && self.params.compressLevel == 0 {
+			log.Infof("compression not accepted by server, %s", self.String())
+		}
+	}
+	if res != nil {
+		res.Body.Close()
 	}
 	return err
 }
 
+func (self *httpClient) finishHandshake(handshake *clientHandshake, res *http.Response) (keys *sessionKeys, err error) {
+	var params *sessionParams
+	cr := &connectResponse{}
+	body, err := io.ReadAll(io.LimitReader(self.ctx.wire.newBodyReader(res.Body), DataBlockSize))
+	if err != nil {
+		err = fmt.Errorf("read connect response fail, err=[%v]", err)
+	} else if err = json.Unmarshal(body, cr); err != nil {
+		err = fmt.Errorf("decode connect response fail, err=[%v]", err)
+	} else if keys, err = handshake.finish(cr, self.ctx.serverKey); err == nil {
+		params, err = self.ctx.sessionParams(self.params.mux, cr)
+	}
+	if err == nil && self.params.mux && self.dest != "" && params.reverse == "" {
+		err = fmt.Errorf("server does not support reverse tunnels")
+	}
+	if err == nil {
+		self.connKey = cr.SessionId
+		self.params = params
+		if self.ctx.streamTransport() != "" && params.transport == TransportPoll {
+			supported := "unknown"
+			if cr.Capabilities != nil {
+				supported = strings.Join(cr.Capabilities.Transports, ",")
+			}
+			log.Infof("stream transport not accepted by server, use long polling, supported=[%s] %s", supported, self.String())
+		}
+	}
+	return keys, err
+}
+
+// Move the data channel of the session to the stream transport. While that fails the session
+// falls back to long polling, and later sessions skip the stream transport for StreamRetryAfterSec.
+func (self *httpClient) openStream() bool {
+	var err error
+	switch self.params.transport {
+	case TransportWebSocket:
+		var ws *wsConn
+		if ws, err = dialWebSocket(self.ctx.hc, self.streamURL(http.MethodGet, 0, nil), self.ctx.wire); err == nil {
+			self.stream = ws
+		}
+	case TransportHTTP2:
+		var hs *httpStream
+		if hs, err = dialHTTPStream(self.ctx.streamHC, self.streamURL(http.MethodPost, 0, nil), self.ctx.wire); err == nil {
+			self.stream = hs
+		}
+	case TransportSplit:
+		var ss *splitClientStream
+		upload_url := func(seq int64, data []byte) string {
+			return self.streamURL(http.MethodPost, seq, data)
+		}
+		if ss, err = dialSplitStream(self.ctx.hc, self.streamURL(http.MethodGet, 0, nil), upload_url, self.ctx.wire, self.retry); err == nil {
+			self.stream = ss
+		}
+	}
+	if err != nil {
+		log.Warnf("open stream fail, fall back to long polling, err=[%v] %s", err, self.String())
+		self.params.transport = TransportPoll
+		self.ctx.blockStream()
+		return false
+	}
+	log.Infof("open stream succ, %s", self.String())
+	return true
+}
+
+// Signed with the session mac key, seq numbers the uploads of the split transport and data is the upload
+func (self *httpClient) streamURL(method string, seq int64, data []byte) string {
+	u := url.URL{
+		Scheme: self.ctx.scheme,
+		Host:   self.ctx.host,
+		Path:   QP_DATA,
+	}
+	q := u.Query()
+	q.Set(QK_CONN_KEY, self.connKey)
+	if self.params.transport != TransportWebSocket {
+		q.Set(QK_TRANSPORT, self.params.transport)
+	}
+	if seq > 0 {
+		q.Set(QK_SEQ, strconv.FormatInt(seq, 10))
+	}
+	u.RawQuery = q.Encode()
+	signSessionRequest(self.keys.macKey, method, &u, payloadHash(self.params.version, data))
+	self.ctx.wire.encodeURL(&u)
+	return u.String()
+}
+
+func (self *httpClient) streamSendLoop() {
+	for atomic.LoadInt32(&self.alive) != 0 {
+		select {
+		case dn := <-self.sendQ:
+			if dn == nil {
+				break
+			}
+			if err := self.stream.writeBlock(dn.data); err != nil {
+				log.Warnf("stream write fail, err=[%v] %s", err, self.String())
+				atomic.StoreInt32(&self.alive, 0)
+			}
+		case <-self.sendQsync:
+		}
+	}
+	self.stream.close()
+}
+
+func (self *httpClient) streamRecvLoop() {
+	for atomic.LoadInt32(&self.alive) != 0 {
+		data, err := self.stream.readBlock()
+		if err != nil {
+			if err != io.EOF {
+				log.Warnf("stream read fail, err=[%v] %s", err, self.String())
+			} else {
+				log.Infof("stream closed by server, %s", self.String())
+			}
+			atomic.StoreInt32(&self.alive, 0)
+			break
+		}
+		if len(data) > 0 {
+			self.recvQ <- &dataBlock{data: data}
+		}
+	}
+	self.stream.close()
+}
+
+// Payload too large to encode into one request is sent in several, the filter on the other side
+// takes the byte stream whatever it is cut into
 func (self *httpClient) sendData(send_dn *dataBlock) {
-	self.seq += 1
+	var data []byte
+	if send_dn != nil {
+		data = send_dn.data
+	}
+	if self.ctx.uploadEncoding != uploadEncodingBody {
+		for len(data) > EncodedPayloadMaxSize {
+			self.sendRequest(data[:EncodedPayloadMaxSize])
+			data = data[EncodedPayloadMaxSize:]
+		}
+	}
+	self.sendRequest(data)
+}
+
+// Returns once the request is in flight, at most inflight requests wait for their response headers
+func (self *httpClient) sendRequest(data []byte) {
+	seq := atomic.AddInt64(&self.seq, 1)
 	u := url.URL{
-		Scheme: "http",
-		Host:   self.host,
+		Scheme: self.ctx.scheme,
+		Host:   self.ctx.host,
 		Path:   QP_DATA,
 	}
 	q := u.Query()
-	q.Set(QK_CONN_KEY, strconv.FormatInt(self.connKey, 10))
-	q.Set(QK_SEQ, strconv.FormatInt(self.seq, 10))
+	q.Set(QK_CONN_KEY, self.connKey)
+	q.Set(QK_SEQ, strconv.FormatInt(seq, 10))
+	q.Set(QK_ACK, strconv.FormatInt(atomic.LoadInt64(&self.ack), 10))
+	if self.ctx.uploadEncoding == uploadEncodingQuery && len(data) > 0 {
+		q.Set(QK_PAYLOAD, base64.RawURLEncoding.EncodeToString(data))
+	}
 	u.RawQuery = q.Encode()
+	signSessionRequest(self.keys.macKey, self.ctx.uploadMethod, &u, payloadHash(self.params.version, data))
+	self.ctx.wire.encodeURL(&u)
 
 	log.Debugf("send date to url=[%s]", u.String())
-	var body io.Reader
-	if send_dn != nil {
-		body = bytes.NewReader(send_dn.data)
+	pending := &pendingResponse{
+		seq: seq,
+		url: u.String(),
+		res: make(chan *http.Response, 1),
 	}
-	req, _ := http.NewRequest(http.MethodGet, u.String(), body)
-	res, err := self.hc.Do(req)
-	if nil != err ||
-		http.StatusOK != res.StatusCode {
+	switch self.ctx.uploadEncoding {
+	case uploadEncodingBody:
+		pending.body = self.ctx.wire.encodeBody(data)
+	case uploadEncodingHeader:
+		pending.body = data
+	}
+	self.inflight <- true
+	self.respQ <- pending
+	go func() {
+		res := self.doRequest(pending)
+		<-self.inflight
+		pending.res <- res
+	}()
+}
+
+// Transport errors and 5xx are retried with backoff. The server answers a retried
+// seq with the response it kept, so no data is lost or applied twice. Nil means
+// the session is given up.
+func (self *httpClient) doRequest(pending *pendingResponse) (res *http.Response) {
+	backoff := time.Duration(RetryBackoffMinMs) * time.Millisecond
+	for atomic.LoadInt32(&self.alive) != 0 {
+		var body io.Reader
+		if len(pending.body) > 0 && self.ctx.uploadEncoding == uploadEncodingBody {
+			body = bytes.NewReader(pending.body)
+		}
+		req, _ := http.NewRequest(self.ctx.uploadMethod, pending.url, body)
+		self.ctx.wire.setRequestHeaders(req, body != nil)
+		if len(pending.body) > 0 && self.ctx.uploadEncoding == uploadEncodingHeader {
+			req.Header.Set(self.ctx.wire.payloadHeader, base64.RawURLEncoding.EncodeToString(pending.body))
+		}
+		res, err := self.ctx.hc.Do(req)
+		if err == nil && http.StatusOK == res.StatusCode {
+			return res
+		}
 		status := ""
+		retryable := (err != nil)
 		if res != nil {
 			status = res.Status
+			retryable = (res.StatusCode >= http.StatusInternalServerError)
+			res.Body.Close()
+		}
+		failed_by := failedBy(err, res)
+		if !self.retryable(pending, retryable) {
+			log.Warnf("do http request fail at %s, err=[%v] status=[%s] seq=%d attempts=%d", failed_by, err, status, pending.seq, pending.attempts)
+			break
+		}
+		log.Warnf("do http request fail at %s, will retry, err=[%v] status=[%s] seq=%d attempts=%d backoff=%v", failed_by, err, status, pending.seq, pending.attempts, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > time.Duration(RetryBackoffMaxMs)*time.Millisecond {
+			backoff = time.Duration(RetryBackoffMaxMs) * time.Millisecond
 		}
-		log.Warnf("do http request fail, err=[%v] status=[%s]", err, status)
-		self.alive = false
-	} else {
-		self.respQ <- res
 	}
+	atomic.StoreInt32(&self.alive, 0)
+	return nil
+}
+
+func (self *httpClient) retryable(pending *pendingResponse, retryable bool) bool {
+	pending.attempts += 1
+	return retryable && pending.attempts <= self.retry && atomic.LoadInt32(&self.alive) != 0
 }
 
 func (self *httpClient) recvLoop() {
-	for res := range self.respQ {
-		if res == nil {
+	for pending := range self.respQ {
+		if pending == nil {
 			break
 		}
-		for {
-			recv_dn := &dataBlock{
-				data: make([]byte, DataBlockSize),
-			}
-			read_ret, err := res.Body.Read(recv_dn.data)
-			if read_ret > 0 {
-				recv_dn.data = recv_dn.data[:read_ret]
-				self.recvQ <- recv_dn
-			}
-			if err != nil {
-				if err != io.EOF {
-					log.Warnf("read fail, read_ret=%d err=[%v]", read_ret, err)
-				} else {
-					log.Infof("connection close, read_ret=%d err=[%v]", read_ret, err)
-				}
+		// A response cut off is requested again, the bytes already delivered are skipped.
+		// Once a seq is given up nothing after it may be delivered.
+		delivered := int64(0)
+		for res := <-pending.res; res != nil; res = self.doRequest(pending) {
+			if atomic.LoadInt32(&self.alive) == 0 {
 				res.Body.Close()
 				break
-			} else {
-				log.Debugf("recv data succ, len=%d", read_ret)
+			} else if self.readResponse(res, &delivered) {
+				atomic.StoreInt64(&self.ack, pending.seq)
+				break
+			} else if !self.retryable(pending, true) {
+				atomic.StoreInt32(&self.alive, 0)
+				break
 			}
 		}
 		if 0 == len(self.respQ) {
@@ -201,7 +649,42 @@ func (self *httpClient) recvLoop() {
 	}
 }
 
+// Return false while the body is cut off, delivered counts the bytes pushed to recvQ
+func (self *httpClient) readResponse(res *http.Response, delivered *int64) bool {
+	defer res.Body.Close()
+	read_bytes := int64(0)
+	res_body := self.ctx.wire.newBodyReader(res.Body)
+	for {
+		recv_dn := &dataBlock{
+			data: make([]byte, DataBlockSize),
+		}
+		read_ret, err := res_body.Read(recv_dn.data)
+		if read_ret > 0 {
+			skip := *delivered - read_bytes
+			read_bytes += int64(read_ret)
+			if skip < int64(read_ret) {
+				if skip < 0 {
+					skip = 0
+				}
+				recv_dn.data = recv_dn.data[skip:read_ret]
+				self.recvQ <- recv_dn
+				*delivered = read_bytes
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Warnf("read fail, read_ret=%d err=[%v] delivered=%d", read_ret, err, *delivered)
+				return false
+			}
+			log.Infof("connection close, read_ret=%d err=[%v]", read_ret, err)
+			return true
+		} else {
+			log.Debugf("recv data succ, len=%d", read_ret)
+		}
+	}
+}
+
 func (self *httpClient) String() string {
-	return fmt.Sprintf("this=%p host=[%s] dest=[%s] seq=%d connKey=%d alive=%t sendQLen=%d respQLen=%d recvQLen=%d",
-		self, self.host, self.dest, self.seq, self.connKey, self.alive, len(self.sendQ), len(self.respQ), len(self.recvQ))
+	return fmt.Sprintf("this=%p host=[%s://%s] dest=[%s] %s seq=%d connKey=[%s] alive=%t sendQLen=%d inflight=%d respQLen=%d recvQLen=%d",
+		self, self.ctx.scheme, self.ctx.host, self.dest, self.params.String(), atomic.LoadInt64(&self.seq), self.connKey, atomic.LoadInt32(&self.alive) != 0, len(self.sendQ), len(self.inflight), len(self.respQ), len(self.recvQ))
 }
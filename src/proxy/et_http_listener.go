@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	log "third/seelog"
+	"time"
+)
+
+// The listener of http mode is an http proxy. CONNECT host:port is a tunnel
+// of its own, a request with an absolute uri is sent to its host through a
+// tunnel that is kept for the next requests to the same host. While
+// client.ListenUser is set clients must send it as basic Proxy-Authorization.
+// A destination denied by the policy of the tunnel server is answered with
+// 403, any other failure to reach it with 502.
+const (
+	HTTPProxyRealm                  = "eTunnel"
+	HTTPProxyHeaderTimeoutSec int64 = 10
+	HTTPProxyIdleTimeoutSec   int64 = 90
+)
+
+type httpProxyHandler struct {
+	clientServer *clientServer
+	reverseProxy *httputil.ReverseProxy
+}
+
+// A hijacked connection, the bytes read ahead by the http server come first
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (self *clientServer) serveHTTPProxy(listener net.Listener) (err error) {
+	handler := &httpProxyHandler{clientServer: self}
+	handler.reverseProxy = &httputil.ReverseProxy{
+		Rewrite: func(*httputil.ProxyRequest) {},
+		Transport: &http.Transport{
+			DialContext:        handler.dialTunnel,
+			IdleConnTimeout:    time.Duration(HTTPProxyIdleTimeoutSec) * time.Second,
+			DisableCompression: true,
+		},
+		ErrorHandler: handler.proxyError,
+	}
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: time.Duration(HTTPProxyHeaderTimeoutSec) * time.Second,
+		IdleTimeout:       time.Duration(HTTPProxyIdleTimeoutSec) * time.Second,
+	}
+	return server.Serve(listener)
+}
+
+func (self *httpProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := self.clientServer.getContext()
+	if !checkProxyAuthorization(r, ctx.listenUser, ctx.listenPassword) {
+		log.Warnf("http proxy auth fail, method=[%s] url=[%s] local=[%s]", r.Method, r.RequestURI, r.RemoteAddr)
+		w.Header().Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", HTTPProxyRealm))
+		http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+	} else if r.Method == http.MethodConnect {
+		self.connect(w, r)
+	} else if r.URL.IsAbs() && r.URL.Host != "" {
+		log.Infof("http proxy request, method=[%s] url=[%s] local=[%s]", r.Method, r.URL.String(), r.RemoteAddr)
+		self.reverseProxy.ServeHTTP(w, r)
+	} else {
+		log.Warnf("not a proxy request, method=[%s] url=[%s] local=[%s]", r.Method, r.RequestURI, r.RemoteAddr)
+		http.Error(w, "not a proxy request", http.StatusBadRequest)
+	}
+}
+
+// The tunnel takes the connection over once the tunnel server reached the host
+func (self *httpProxyHandler) connect(w http.ResponseWriter, r *http.Request) {
+	dest := r.Host
+	if _, port, err := net.SplitHostPort(dest); err != nil || port == "" {
+		log.Warnf("invalid connect address, dest=[%s] local=[%s]", dest, r.RemoteAddr)
+		http.Error(w, "invalid connect address", http.StatusBadRequest)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijack not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		log.Warnf("hijack connection fail, err=[%v] dest=[%s] local=[%s]", err, dest, r.RemoteAddr)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	log.Infof("http proxy connect, dest=[%s] local=[%s]", dest, r.RemoteAddr)
+	self.clientServer.openTunnel(&bufferedConn{Conn: conn, reader: rw.Reader}, dest, func(err error) error {
+		if err != nil {
+			status := httpProxyStatus(err)
+			log.Warnf("http proxy connect fail, err=[%v] status=%d dest=[%s] local=[%s]", err, status, dest, r.RemoteAddr)
+			return writeProxyResponse(conn, status, err.Error())
+		}
+		return writeProxyResponse(conn, http.StatusOK, "")
+	})
+}
+
+// A pipe carries the requests of the transport, it is returned once the tunnel server reached addr
+func (self *httpProxyHandler) dialTunnel(ctx context.Context, network string, addr string) (conn net.Conn, err error) {
+	local, remote := net.Pipe()
+	result := make(chan error, 1)
+	go self.clientServer.openTunnel(remote, addr, func(err error) error {
+		result <- err
+		return nil
+	})
+	select {
+	case err = <-result:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		local.Close()
+		return conn, err
+	}
+	conn = local
+	return conn, err
+}
+
+func (self *httpProxyHandler) proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	status := httpProxyStatus(err)
+	log.Warnf("http proxy request fail, err=[%v] status=%d url=[%s] local=[%s]", err, status, r.URL.String(), r.RemoteAddr)
+	http.Error(w, err.Error(), status)
+}
+
+func (self *bufferedConn) Read(p []byte) (int, error) {
+	return self.reader.Read(p)
+}
+
+// Always true while no user is configured
+func checkProxyAuthorization(r *http.Request, user string, password string) bool {
+	if user == "" {
+		return true
+	}
+	scheme, credential, _ := strings.Cut(r.Header.Get("Proxy-Authorization"), " ")
+	if !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(credential)
+	if err != nil {
+		return false
+	}
+	req_user, req_password, ok := strings.Cut(string(decoded), ":")
+	return ok && subtle.ConstantTimeCompare([]byte(req_user), []byte(user)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(req_password), []byte(password)) == 1
+}
+
+func writeProxyResponse(conn net.Conn, status int, msg string) (err error) {
+	if status == http.StatusOK {
+		_, err = fmt.Fprintf(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	} else {
+		_, err = fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+			status, http.StatusText(status), len(msg)+1, msg+"\n")
+	}
+	return err
+}
+
+// A destination denied by the policy of the tunnel server is forbidden, any other failure is a bad gateway
+func httpProxyStatus(err error) int {
+	var refused *sessionRefusedError
+	if err == nil {
+		return http.StatusOK
+	} else if errors.As(err, &refused) && (refused.code == FailureDenied || refused.status == http.StatusForbidden) {
+		return http.StatusForbidden
+	}
+	return http.StatusBadGateway
+}
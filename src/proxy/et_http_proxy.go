@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"common"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	log "third/seelog"
+)
+
+// Requests to the tunnel server go through client.ProxyURL when set, otherwise through
+// the proxy of HTTP_PROXY, HTTPS_PROXY and NO_PROXY unless client.ProxyIgnoreEnvironment
+// is set. An http proxy forwards plain http requests and tunnels https with CONNECT, a
+// socks5 proxy tunnels both.
+const (
+	FailedByProxy  = "proxy"
+	FailedByServer = "tunnel server"
+)
+
+type proxyConnectError struct {
+	status string
+}
+
+func (self *proxyConnectError) Error() string {
+	return fmt.Sprintf("proxy refused connect, status=[%s]", self.status)
+}
+
+func parseProxyURL(proxy_url string, user string, password string) (u *url.URL, err error) {
+	if !strings.Contains(proxy_url, "://") {
+		proxy_url = "http://" + proxy_url
+	}
+	if u, err = url.Parse(proxy_url); err != nil {
+		return u, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return u, fmt.Errorf("unsupported proxy scheme, scheme=[%s]", u.Scheme)
+	}
+	if u.Host == "" {
+		return u, fmt.Errorf("no proxy host")
+	}
+	if user != "" {
+		u.User = url.UserPassword(user, password)
+	}
+	return u, err
+}
+
+// Nil proxy means requests go straight to the tunnel server
+func newClientProxy(c *common.ClientConfig) (proxy func(*http.Request) (*url.URL, error), err error) {
+	if c.ProxyURL == "" {
+		if c.ProxyIgnoreEnvironment {
+			return proxy, err
+		}
+		return http.ProxyFromEnvironment, err
+	}
+	u, err := parseProxyURL(c.ProxyURL, c.ProxyUser, c.ProxyPassword)
+	if err != nil {
+		return proxy, fmt.Errorf("invalid proxy url, err=[%v] url=[%s]", err, c.ProxyURL)
+	}
+	log.Infof("requests go through proxy, url=[%s]", u.Redacted())
+	return http.ProxyURL(u), err
+}
+
+// The transport reports a refused CONNECT with the bare status text, keep the status and who said it
+func onProxyConnectResponse(ctx context.Context, proxy_url *url.URL, req *http.Request, res *http.Response) error {
+	if res.StatusCode != http.StatusOK {
+		return &proxyConnectError{status: res.Status}
+	}
+	return nil
+}
+
+// Who failed a request, the proxy or the tunnel server. A tunneling proxy that can not reach
+// the server fails itself, its error says why. A forwarding proxy answering a plain http
+// request with an error status of its own is only told apart by 407 here, connectFailedBy
+// tells it apart by the body for connects.
+func failedBy(err error, res *http.Response) string {
+	var op_err *net.OpError
+	var connect_err *proxyConnectError
+	if err != nil {
+		if errors.As(err, &connect_err) {
+			return FailedByProxy
+		} else if errors.As(err, &op_err) && (op_err.Op == "proxyconnect" || strings.HasPrefix(op_err.Op, "socks")) {
+			return FailedByProxy
+		}
+	} else if res != nil && res.StatusCode == http.StatusProxyAuthRequired {
+		return FailedByProxy
+	}
+	return FailedByServer
+}
+
+// A forwarding proxy answers the plain http requests it passes on, tunneling ones only tunnel
+func forwardedByProxy(proxy func(*http.Request) (*url.URL, error), req *http.Request) bool {
+	if proxy == nil || req == nil || req.URL.Scheme != "http" {
+		return false
+	}
+	u, err := proxy(req)
+	return err == nil && u != nil && (u.Scheme == "http" || u.Scheme == "https")
+}
@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestForwardedByProxy(t *testing.T) {
+	through := func(proxy_url string) func(*http.Request) (*url.URL, error) {
+		return func(*http.Request) (*url.URL, error) {
+			return url.Parse(proxy_url)
+		}
+	}
+	direct := func(*http.Request) (*url.URL, error) {
+		return nil, nil
+	}
+	cases := []struct {
+		name      string
+		proxy     func(*http.Request) (*url.URL, error)
+		target    string
+		forwarded bool
+	}{
+		{"no proxy", nil, "http://server/connect", false},
+		{"proxy skips host", direct, "http://server/connect", false},
+		{"http through http proxy", through("http://proxy:3128"), "http://server/connect", true},
+		{"http through https proxy", through("https://proxy:3128"), "http://server/connect", true},
+		{"https tunneled", through("http://proxy:3128"), "https://server/connect", false},
+		{"http through socks proxy", through("socks5://proxy:1080"), "http://server/connect", false},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest(http.MethodGet, c.target, nil)
+		if forwarded := forwardedByProxy(c.proxy, req); forwarded != c.forwarded {
+			t.Fatalf("%s: forwarded=%t want=%t", c.name, forwarded, c.forwarded)
+		}
+	}
+}
@@ -1,72 +1,424 @@
 package proxy
 
 import (
+	"common"
+	"crypto/rsa"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
 	"sync"
 	log "third/seelog"
+	"time"
 )
 
 type httpRequest struct {
 	httpWrapper iHTTPWrapper
+	replay      *replayEntry
 	wg          sync.WaitGroup
 }
 
 type proxyServer struct {
 	lock         sync.RWMutex
+	keyring      *serverKeyring
+	identities   *identityMgr
+	wire         *wireFormat
+	capabilities *serverCapabilities
 	tcpClientMgr map[string]iTCPClient
 }
 
+// Everything replaced by Reload, sessions keep what they got at connect time
+type serverKeyring struct {
+	privateKey *rsa.PrivateKey
+	auth       iAuthenticator
+	tlsConfig  *tls.Config
+}
+
 type tcpClientMgrCallback struct {
 	proxyServer *proxyServer
 	connKey     string
+	identity    *identity
+	// listener of a reverse session, closed with the session
+	reverseListener *net.TCPListener
+}
+
+// Opens the streams of a multiplexed session, every stream takes a session slot of the identity
+type muxHandler struct {
+	proxyServer *proxyServer
+	identity    *identity
+	remote      string
 }
 
-func NewProxyServer() *proxyServer {
-	ps := &proxyServer{
-		tcpClientMgr: make(map[string]iTCPClient),
+func NewProxyServer() (ps *proxyServer) {
+	var identities *identityMgr
+	var wire *wireFormat
+	var capabilities *serverCapabilities
+	keyring, err := newServerKeyring(nil)
+	if err != nil {
+		log.Errorf("newServerKeyring fail, err=[%v]", err)
+	} else if identities, err = newIdentityMgr(); err != nil {
+		log.Errorf("newIdentityMgr fail, err=[%v]", err)
+	} else if wire, err = newWireFormat(); err != nil {
+		log.Errorf("newWireFormat fail, err=[%v]", err)
+	} else if err = checkCompressLevel(common.G.Server.CompressionLevel); err != nil {
+		log.Errorf("checkCompressLevel fail, err=[%v]", err)
+	} else if err = checkFilterChain(common.G.Server.Filters); err != nil {
+		log.Errorf("checkFilterChain fail, err=[%v]", err)
+	} else if capabilities, err = newServerCapabilities(); err != nil {
+		log.Errorf("newServerCapabilities fail, err=[%v]", err)
+	} else {
+		ps = &proxyServer{
+			keyring:      keyring,
+			identities:   identities,
+			wire:         wire,
+			capabilities: capabilities,
+			tcpClientMgr: make(map[string]iTCPClient),
+		}
 	}
 	return ps
 }
 
+// Credentials of previous are accepted for a grace window by the new keyring
+func newServerKeyring(previous *serverKeyring) (keyring *serverKeyring, err error) {
+	var private_key *rsa.PrivateKey
+	var tls_config *tls.Config
+	key_file := common.Config().Server.PrivateKeyFilePath
+	if private_key, err = common.LoadPrivateKey(key_file); err != nil {
+		err = fmt.Errorf("load private key fail, err=[%v] path=[%s]", err, key_file)
+	} else if tls_config, err = newServerTLSConfig(); err != nil {
+		err = fmt.Errorf("newServerTLSConfig fail, err=[%v]", err)
+	} else {
+		log.Infof("load private key succ, fingerprint=[%s] path=[%s]",
+			common.KeyFingerprint(&private_key.PublicKey), key_file)
+		keyring = &serverKeyring{
+			privateKey: private_key,
+			tlsConfig:  tls_config,
+		}
+		if previous == nil {
+			keyring.auth, err = newAuthenticator(nil)
+		} else {
+			keyring.auth, err = previous.auth.reload()
+		}
+	}
+	return keyring, err
+}
+
+// New sessions use the new keys, running sessions finish with the keys they negotiated
+func (self *proxyServer) Reload() (err error) {
+	keyring, err := newServerKeyring(self.getKeyring())
+	if err != nil {
+		return err
+	}
+	if (keyring.tlsConfig == nil) != (self.getKeyring().tlsConfig == nil) {
+		return fmt.Errorf("enable or disable tls needs restart")
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.keyring = keyring
+	return err
+}
+
+func (self *proxyServer) getKeyring() *serverKeyring {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.keyring
+}
+
+// Http2 is served over tls and as cleartext h2c while HTTP2Enable is set
+func (self *proxyServer) Protocols() (protocols *http.Protocols) {
+	protocols = &http.Protocols{}
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(common.G.Server.HTTP2Enable)
+	protocols.SetUnencryptedHTTP2(common.G.Server.HTTP2Enable)
+	return protocols
+}
+
+// Nil while tls is not configured, the certificate and client ca follow Reload
+func (self *proxyServer) TLSConfig() (config *tls.Config) {
+	if self.getKeyring().tlsConfig == nil {
+		return config
+	}
+	config = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"http/1.1"},
+	}
+	if common.G.Server.HTTP2Enable {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		current := self.getKeyring().tlsConfig.Clone()
+		current.NextProtos = config.NextProtos
+		return current, nil
+	}
+	return config
+}
+
 func (self *proxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	conn_key := r.URL.Query().Get(QK_CONN_KEY)
-	tcp_client := self.getTCPClient(conn_key)
 	http_request := &httpRequest{
-		httpWrapper: newHTTPWrapper(r, w),
+		httpWrapper: newHTTPWrapper(r, w, self.wire),
+	}
+	if !self.wire.decodeURL(r.URL) {
+		log.Warnf("invalid path, remote=[%s] url=[%s]", r.RemoteAddr, r.URL.String())
+		http_request.httpWrapper.setErrorStatus(self.wire.unknownPathStatus())
+		return
 	}
 	switch strings.TrimPrefix(r.URL.Path, "/") {
 	case QP_CONNECT:
-		if tcp_client != nil {
-			log.Warnf("connection already exist, url=[%s]", r.URL.String())
-			http_request.httpWrapper.setErrorHappened()
+		if name, err := self.authenticate(self.getKeyring().auth, r); err != nil {
+			log.Warnf("authenticate fail, err=[%v] remote=[%s] url=[%s]", err, r.RemoteAddr, r.URL.Path)
+			http_request.httpWrapper.setErrorStatus(http.StatusUnauthorized)
 		} else {
-			addr := r.URL.Query().Get(QK_ADDR)
-			tcp_client = newTCPClient(addr, &tcpClientMgrCallback{self, conn_key})
-			if tcp_client == nil {
-				log.Warnf("newTCPClient fail, url=[%s]", r.URL.String())
-				http_request.httpWrapper.setErrorHappened()
-			} else {
-				log.Infof("newTCPClient succ, %s", tcp_client.String())
-				self.addTCPClient(conn_key, tcp_client)
-			}
+			self.connect(self.identities.get(name), r, http_request)
 		}
 	case QP_DATA:
+		conn_key := r.URL.Query().Get(QK_CONN_KEY)
+		transport := r.URL.Query().Get(QK_TRANSPORT)
+		tcp_client := self.getTCPClient(conn_key)
+		// all but the requests opening a stream carry a payload, it is read before the signature is checked
+		load_payload := func() (err error) {
+			if !isWebSocketUpgrade(r) && transport != TransportHTTP2 && (transport != TransportSplit || r.Method != http.MethodGet) {
+				err = http_request.httpWrapper.loadBody()
+			}
+			return err
+		}
 		if tcp_client == nil {
-			log.Warnf("connection not exist, url=[%s]", r.URL.String())
-			http_request.httpWrapper.setErrorHappened()
+			log.Warnf("connection not exist, remote=[%s] url=[%s]", r.RemoteAddr, r.URL.String())
+			http_request.httpWrapper.setErrorStatus(http.StatusGone)
+		} else if err := load_payload(); err != nil {
+			log.Warnf("read request body fail, err=[%v] remote=[%s] %s", err, r.RemoteAddr, tcp_client.String())
+			http_request.httpWrapper.setErrorStatus(http.StatusBadRequest)
+		} else if err := tcp_client.verifyRequest(r, http_request.httpWrapper.payload()); err != nil {
+			log.Warnf("verify session request fail, err=[%v] remote=[%s] %s", err, r.RemoteAddr, tcp_client.String())
+			http_request.httpWrapper.setErrorStatus(http.StatusUnauthorized)
+		} else if isWebSocketUpgrade(r) {
+			self.upgrade(tcp_client, w, r, http_request)
+		} else if transport == TransportHTTP2 {
+			self.stream(tcp_client, w, r, http_request)
+		} else if transport == TransportSplit {
+			self.split(tcp_client, w, r, http_request)
 		} else {
 			seq_number, _ := strconv.ParseInt(r.URL.Query().Get(QK_SEQ), 10, 64)
-			tcp_client.pushHTTPRequest(seq_number, http_request)
+			ack, _ := strconv.ParseInt(r.URL.Query().Get(QK_ACK), 10, 64)
+			tcp_client.pushHTTPRequest(seq_number, ack, http_request)
 			http_request.wg.Wait()
 		}
 	default:
-		log.Warnf("invalid path, url=[%s]", r.URL.String())
+		log.Warnf("invalid path, remote=[%s] url=[%s]", r.RemoteAddr, r.URL.String())
+		http_request.httpWrapper.setErrorStatus(self.wire.unknownPathStatus())
+	}
+}
+
+// The certificate subject and the credential id must agree while both are presented
+func (self *proxyServer) authenticate(auth iAuthenticator, r *http.Request) (name string, err error) {
+	cert_name := certIdentity(r)
+	if name, err = auth.verify(r); err == nil && cert_name != "" {
+		if name != "" && name != cert_name {
+			err = fmt.Errorf("credential not match client certificate, id=[%s] subject=[%s]", name, cert_name)
+		} else {
+			name = cert_name
+		}
+	}
+	return name, err
+}
+
+// A multiplexed session dials nothing at connect, its streams take the session slots instead.
+// A reverse session listens at connect, every connection accepted takes a session slot.
+func (self *proxyServer) connect(id *identity, r *http.Request, http_request *httpRequest) {
+	addr := r.URL.Query().Get(QK_ADDR)
+	params, err := self.capabilities.sessionParams(r.URL.Query())
+	if err != nil {
+		log.Warnf("connect refused, err=[%v] remote=[%s] addr=[%s]", err, r.RemoteAddr, addr)
+		http_request.httpWrapper.setErrorMessage(http.StatusBadRequest, err.Error())
+		return
+	}
+	session_id := id
+	if params.mux {
+		session_id = nil
+	} else if err := self.identities.acquire(id); err != nil {
+		log.Warnf("audit: connect refused, err=[%v] remote=[%s] addr=[%s]", err, r.RemoteAddr, addr)
+		refuseConnect(http_request, params, http.StatusTooManyRequests, err)
+		return
+	}
+	release := func() {
+		if session_id != nil {
+			self.identities.release(session_id)
+		}
+	}
+	conn_key, err := newSessionId()
+	if err != nil {
+		log.Warnf("newSessionId fail, err=[%v]", err)
 		http_request.httpWrapper.setErrorHappened()
+		release()
+		return
+	}
+	cr, keys, err := serverHandshake(conn_key, r.URL.Query().Get(QK_HANDSHAKE), hasFilter(params.filters, FilterEncrypt), self.getKeyring().privateKey)
+	if err != nil {
+		log.Warnf("connection handshake fail, err=[%v] url=[%s]", err, r.URL.String())
+		http_request.httpWrapper.setErrorHappened()
+		release()
+		return
+	}
+	if params.transport != TransportPoll {
+		cr.Transport = params.transport
+	}
+	cr.Compress = hasFilter(params.filters, FilterCompress)
+	if r.URL.Query().Get(QK_FILTERS) != "" {
+		cr.Filters = params.filters
+	}
+	cr.Version = ProtocolVersion
+	cr.BlockSize = params.blockSize
+	cr.Capabilities = self.capabilities
+	dn_filter := newSessionFilter(keys, params)
+	if dn_filter == nil {
+		log.Warnf("newSessionFilter fail, url=[%s]", r.URL.String())
+		http_request.httpWrapper.setErrorHappened()
+		release()
+		return
+	}
+	var tcp_proxy iTCPProxy
+	var mux *muxProxy
+	var reverse_listener *net.TCPListener
+	if params.reverse != "" {
+		var status int
+		if reverse_listener, status, err = self.listenReverse(id, r.RemoteAddr, params.reverse); err != nil {
+			refuseConnect(http_request, params, status, err)
+			release()
+			return
+		}
+		params.reverse = reverse_listener.Addr().String()
+		cr.Reverse = params.reverse
+	}
+	if params.mux {
+		mux = newMuxProxy(dn_filter, &muxHandler{self, id, r.RemoteAddr}, 2, 0, params.version)
+		tcp_proxy = mux
+	} else if tcp_conn, status, err := self.dial(id, r.RemoteAddr, addr); err != nil {
+		refuseConnect(http_request, params, status, err)
+		release()
+		return
+	} else {
+		tcp_proxy = newTCPProxy(tcp_conn, dn_filter)
+	}
+	body, _ := json.Marshal(cr)
+	tcp_client := newTCPClient(tcp_proxy, id.name, keys, params, &tcpClientMgrCallback{self, conn_key, session_id, reverse_listener})
+	log.Infof("newTCPClient succ, %s", tcp_client.String())
+	self.addTCPClient(conn_key, tcp_client)
+	if reverse_listener != nil {
+		go self.serveReverse(id, r.RemoteAddr, mux, reverse_listener)
+	}
+	http_request.httpWrapper.startResponse()
+	http_request.httpWrapper.pushData(&dataBlock{data: body})
+}
+
+// The session is carried by the websocket until it closes, it takes no data request after the upgrade.
+// A failed upgrade leaves it on long polling.
+func (self *proxyServer) upgrade(tcp_client iTCPClient, w http.ResponseWriter, r *http.Request, http_request *httpRequest) {
+	if !common.G.Server.WebSocketEnable {
+		log.Warnf("websocket not enabled, remote=[%s] %s", r.RemoteAddr, tcp_client.String())
+		http_request.httpWrapper.setErrorStatus(http.StatusBadRequest)
+	} else if err := checkWebSocketHandshake(r); err != nil {
+		log.Warnf("invalid websocket handshake, err=[%v] remote=[%s] %s", err, r.RemoteAddr, tcp_client.String())
+		http_request.httpWrapper.setErrorStatus(http.StatusBadRequest)
+	} else if err := tcp_client.attachStream(nil); err != nil {
+		log.Warnf("attach websocket fail, err=[%v] remote=[%s] %s", err, r.RemoteAddr, tcp_client.String())
+		http_request.httpWrapper.setErrorStatus(http.StatusConflict)
+	} else if ws, err := acceptWebSocket(w, r); err != nil {
+		// The client takes an upgrade not answered with 101 as refused and keeps polling this session
+		log.Warnf("accept websocket fail, fall back to long polling, err=[%v] remote=[%s] %s", err, r.RemoteAddr, tcp_client.String())
+		tcp_client.detachStream()
+	} else {
+		tcp_client.serveStream(ws)
+	}
+}
+
+// Full duplex over one http2 request, the handler streams the response until the session ends
+func (self *proxyServer) stream(tcp_client iTCPClient, w http.ResponseWriter, r *http.Request, http_request *httpRequest) {
+	if !common.G.Server.HTTP2Enable {
+		log.Warnf("http2 not enabled, remote=[%s] %s", r.RemoteAddr, tcp_client.String())
+		http_request.httpWrapper.setErrorStatus(http.StatusBadRequest)
+	} else if r.ProtoMajor != 2 {
+		log.Warnf("stream request needs http2, proto=[%s] remote=[%s] %s", r.Proto, r.RemoteAddr, tcp_client.String())
+		http_request.httpWrapper.setErrorStatus(http.StatusBadRequest)
+	} else if err := tcp_client.attachStream(nil); err != nil {
+		log.Warnf("attach http2 stream fail, err=[%v] remote=[%s] %s", err, r.RemoteAddr, tcp_client.String())
+		http_request.httpWrapper.setErrorStatus(http.StatusConflict)
+	} else if hs, err := acceptHTTPStream(w, r, self.wire); err != nil {
+		log.Warnf("accept http2 stream fail, err=[%v] remote=[%s] %s", err, r.RemoteAddr, tcp_client.String())
+		tcp_client.serveStream(nil)
+	} else {
+		tcp_client.serveStream(hs)
+	}
+}
+
+// A get opens the download of a split session, every post is an upload of it
+func (self *proxyServer) split(tcp_client iTCPClient, w http.ResponseWriter, r *http.Request, http_request *httpRequest) {
+	if !common.G.Server.SplitEnable {
+		log.Warnf("split transport not enabled, remote=[%s] %s", r.RemoteAddr, tcp_client.String())
+		http_request.httpWrapper.setErrorStatus(http.StatusBadRequest)
+	} else if r.Method == http.MethodGet {
+		split := newSplitServerStream()
+		if err := tcp_client.attachStream(split); err != nil {
+			log.Warnf("attach split stream fail, err=[%v] remote=[%s] %s", err, r.RemoteAddr, tcp_client.String())
+			http_request.httpWrapper.setErrorStatus(http.StatusConflict)
+		} else if hs, err := acceptHTTPStream(w, r, self.wire); err != nil {
+			log.Warnf("accept split stream fail, err=[%v] remote=[%s] %s", err, r.RemoteAddr, tcp_client.String())
+			tcp_client.serveStream(nil)
+		} else {
+			split.open(hs)
+			tcp_client.serveStream(split)
+		}
+	} else if err := http_request.httpWrapper.loadBody(); err != nil {
+		log.Warnf("read upload body fail, err=[%v] remote=[%s] %s", err, r.RemoteAddr, tcp_client.String())
+		http_request.httpWrapper.setErrorStatus(http.StatusBadRequest)
+	} else {
+		seq_number, _ := strconv.ParseInt(r.URL.Query().Get(QK_SEQ), 10, 64)
+		var data []byte
+		if dn := http_request.httpWrapper.popData(); dn != nil {
+			data = dn.data
+		}
+		if err := tcp_client.pushUpload(seq_number, data); err != nil {
+			log.Warnf("push upload fail, err=[%v] remote=[%s] %s", err, r.RemoteAddr, tcp_client.String())
+			http_request.httpWrapper.setErrorStatus(http.StatusConflict)
+		} else {
+			tcp_client.keepAlive()
+			http_request.httpWrapper.startResponse()
+			http_request.httpWrapper.pushData(nil)
+		}
 	}
 }
 
+// Check the destination policy and dial, status is the http status to report on failure
+func (self *proxyServer) dial(id *identity, remote string, addr string) (tcp_conn *net.TCPConn, status int, err error) {
+	identity := id.name
+	tcp_addr, err := id.policy.resolve(addr)
+	if denied, ok := err.(*destDeniedError); ok {
+		log.Warnf("audit: connect denied, identity=[%s] remote=[%s] addr=[%s] reason=[%s]", identity, remote, addr, denied.reason)
+		return nil, http.StatusForbidden, err
+	} else if err != nil {
+		log.Warnf("resolve destination fail, err=[%v] identity=[%s] remote=[%s] addr=[%s]", err, identity, remote, addr)
+		return nil, http.StatusBadGateway, fmt.Errorf("resolve destination fail, err=[%w]", err)
+	}
+	log.Infof("audit: connect allowed, identity=[%s] remote=[%s] addr=[%s] ip=[%s]", identity, remote, addr, tcp_addr.String())
+	conn, err := net.DialTimeout("tcp", tcp_addr.String(), time.Duration(common.G.Server.ConnectionTimeoutSec)*time.Second)
+	if err != nil {
+		log.Warnf("dial destination fail, err=[%v] addr=[%s] ip=[%s]", err, addr, tcp_addr.String())
+		return nil, http.StatusBadGateway, fmt.Errorf("dial destination fail, err=[%w]", err)
+	}
+	return conn.(*net.TCPConn), http.StatusOK, err
+}
+
+// Clients of FailureCodeVersion are told the failure code of err along with the reason
+func refuseConnect(http_request *httpRequest, params *sessionParams, status int, err error) {
+	msg := err.Error()
+	if params.version >= FailureCodeVersion {
+		body, _ := json.Marshal(&connectRefusal{Code: failureCode(err), Reason: msg})
+		msg = string(body)
+	}
+	http_request.httpWrapper.setErrorMessage(status, msg)
+}
+
 func (self *proxyServer) deleteTCPClient(conn_key string) {
 	self.lock.Lock()
 	defer self.lock.Unlock()
@@ -88,8 +440,29 @@ func (self *proxyServer) getTCPClient(conn_key string) (tcp_client iTCPClient) {
 
 func (self *tcpClientMgrCallback) onDestroy() {
 	self.proxyServer.deleteTCPClient(self.connKey)
+	if self.reverseListener != nil {
+		self.reverseListener.Close()
+	}
+	if self.identity != nil {
+		self.proxyServer.identities.release(self.identity)
+	}
 }
 
 func (self *tcpClientMgrCallback) getConnKey() string {
 	return self.connKey
 }
+
+func (self *muxHandler) openStream(addr string) (conn *net.TCPConn, status int, err error) {
+	if err = self.proxyServer.identities.acquire(self.identity); err != nil {
+		log.Warnf("audit: connect refused, err=[%v] remote=[%s] addr=[%s]", err, self.remote, addr)
+		return nil, http.StatusTooManyRequests, err
+	}
+	if conn, status, err = self.proxyServer.dial(self.identity, self.remote, addr); err != nil {
+		self.proxyServer.identities.release(self.identity)
+	}
+	return conn, status, err
+}
+
+func (self *muxHandler) closeStream(addr string) {
+	self.proxyServer.identities.release(self.identity)
+}
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"encoding/base64"
 	"fmt"
 	"io"
 	"net/http"
@@ -8,8 +9,12 @@ import (
 )
 
 type iHTTPWrapper interface {
+	loadBody() (err error)
+	payload() []byte
 	popData() (dn *dataBlock)
 	setErrorHappened()
+	setErrorStatus(status int)
+	setErrorMessage(status int, msg string)
 	startResponse()
 	pushData(dn *dataBlock)
 	String() string
@@ -18,22 +23,75 @@ type iHTTPWrapper interface {
 type httpWrapper struct {
 	req       *http.Request
 	resWriter http.ResponseWriter
+	wire      *wireFormat
+	body      io.Reader
+	loaded    bool
+	data      []byte
 }
 
-func newHTTPWrapper(req *http.Request, res_writer http.ResponseWriter) (hs iHTTPWrapper) {
+func newHTTPWrapper(req *http.Request, res_writer http.ResponseWriter, wire *wireFormat) (hs iHTTPWrapper) {
 	hs_impl := &httpWrapper{
 		req:       req,
 		resWriter: res_writer,
+		wire:      wire,
+		body:      wire.newBodyReader(req.Body),
 	}
 	hs = hs_impl
 	return hs
 }
 
+// Read the whole request body, so a request cut off in the middle is never applied.
+// A request without body may carry its payload encoded in the query or a header.
+func (self *httpWrapper) loadBody() (err error) {
+	if self.loaded {
+		return err
+	}
+	limit := 2 * DataBlockSize
+	data, err := io.ReadAll(io.LimitReader(self.body, limit+1))
+	self.req.Body.Close()
+	if err == nil && len(data) == 0 {
+		data, err = self.loadEncodedPayload()
+	}
+	if err == nil && int64(len(data)) > limit {
+		err = fmt.Errorf("request body too large, limit=%d", limit)
+	}
+	if err == nil {
+		self.data = data
+		self.loaded = true
+	}
+	return err
+}
+
+func (self *httpWrapper) loadEncodedPayload() (data []byte, err error) {
+	payload := self.req.URL.Query().Get(QK_PAYLOAD)
+	if payload == "" {
+		payload = self.req.Header.Get(self.wire.payloadHeader)
+	}
+	if payload != "" {
+		if data, err = base64.RawURLEncoding.DecodeString(payload); err != nil {
+			err = fmt.Errorf("decode encoded payload fail, err=[%v]", err)
+		}
+	}
+	return data, err
+}
+
+// The payload loaded and not popped yet, nil before loadBody
+func (self *httpWrapper) payload() []byte {
+	return self.data
+}
+
 func (self *httpWrapper) popData() (dn *dataBlock) {
+	if self.loaded {
+		if len(self.data) > 0 {
+			dn = &dataBlock{data: self.data}
+			self.data = nil
+		}
+		return dn
+	}
 	dn = &dataBlock{
 		data: make([]byte, DataBlockSize),
 	}
-	read_ret, err := self.req.Body.Read(dn.data)
+	read_ret, err := self.body.Read(dn.data)
 	if err != nil {
 		if err != io.EOF && err != http.ErrBodyReadAfterClose {
 			log.Warnf("read fail, read_ret=%d err=[%v]", read_ret, err)
@@ -51,22 +109,34 @@ func (self *httpWrapper) popData() (dn *dataBlock) {
 }
 
 func (self *httpWrapper) setErrorHappened() {
-	self.resWriter.WriteHeader(http.StatusBadGateway)
+	self.setErrorStatus(http.StatusBadGateway)
+}
+
+func (self *httpWrapper) setErrorStatus(status int) {
+	self.resWriter.WriteHeader(status)
 	self.resWriter.Write(nil)
 	self.resWriter.(http.Flusher).Flush()
 }
 
+func (self *httpWrapper) setErrorMessage(status int, msg string) {
+	self.resWriter.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	self.resWriter.WriteHeader(status)
+	self.resWriter.Write([]byte(msg))
+	self.resWriter.(http.Flusher).Flush()
+}
+
 func (self *httpWrapper) startResponse() {
+	self.wire.setResponseHeaders(self.resWriter.Header())
 	self.resWriter.WriteHeader(http.StatusOK)
 	self.resWriter.(http.Flusher).Flush()
 }
 
 func (self *httpWrapper) pushData(dn *dataBlock) {
 	if dn != nil {
-		self.resWriter.Write(dn.data)
+		self.resWriter.Write(self.wire.encodeBody(dn.data))
 		log.Debugf("http response write data, len=%d", len(dn.data))
 	} else {
-		self.resWriter.Write(nil)
+		self.resWriter.Write(self.wire.encodeBody(nil))
 		log.Debugf("http response write nil")
 	}
 	self.resWriter.(http.Flusher).Flush()
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"common"
+	"fmt"
+	"net/http"
+	"sync"
+	log "third/seelog"
+)
+
+// An identity is the client certificate subject or the credential id of a session,
+// anonymous sessions share the identity with empty name. Identities not listed in
+// server.Identities use the global destination policy, reverse bind policy and
+// MaxSessionsPerIdentity.
+type identity struct {
+	name          string
+	policy        iDestPolicy
+	reversePolicy *reversePolicy
+	maxSessions   int64
+	sessions      int64
+}
+
+type identityMgr struct {
+	lock                 sync.Mutex
+	identities           map[string]*identity
+	defaultPolicy        iDestPolicy
+	defaultReversePolicy *reversePolicy
+}
+
+func newIdentityMgr() (im *identityMgr, err error) {
+	im_impl := &identityMgr{
+		identities: make(map[string]*identity),
+	}
+	if im_impl.defaultPolicy, err = newDestPolicy(common.G.Server.AllowDestinations, common.G.Server.DenyDestinations); err != nil {
+		return im, fmt.Errorf("newDestPolicy fail, err=[%v]", err)
+	}
+	if im_impl.defaultReversePolicy, err = newReversePolicy(common.G.Server.AllowReverseBinds); err != nil {
+		return im, fmt.Errorf("newReversePolicy fail, err=[%v]", err)
+	}
+	log.Infof("default destination policy, %s reverse=[%s] maxSessions=%d",
+		im_impl.defaultPolicy.String(), im_impl.defaultReversePolicy.String(), common.G.Server.MaxSessionsPerIdentity)
+	for _, c := range common.G.Server.Identities {
+		allow := common.G.Server.AllowDestinations
+		if len(c.AllowDestinations) != 0 {
+			allow = c.AllowDestinations
+		}
+		deny := append(append([]string{}, common.G.Server.DenyDestinations...), c.DenyDestinations...)
+		allow_reverse := common.G.Server.AllowReverseBinds
+		if len(c.AllowReverseBinds) != 0 {
+			allow_reverse = c.AllowReverseBinds
+		}
+		id := &identity{
+			name:        c.Name,
+			maxSessions: c.MaxSessions,
+		}
+		if id.policy, err = newDestPolicy(allow, deny); err != nil {
+			return im, fmt.Errorf("newDestPolicy fail, err=[%v] identity=[%s]", err, c.Name)
+		}
+		if id.reversePolicy, err = newReversePolicy(allow_reverse); err != nil {
+			return im, fmt.Errorf("newReversePolicy fail, err=[%v] identity=[%s]", err, c.Name)
+		}
+		log.Infof("identity destination policy, name=[%s] %s reverse=[%s] maxSessions=%d",
+			c.Name, id.policy.String(), id.reversePolicy.String(), id.maxSessions)
+		im_impl.identities[c.Name] = id
+	}
+	im = im_impl
+	return im, err
+}
+
+func (self *identityMgr) get(name string) (id *identity) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	id = self.identities[name]
+	if id == nil {
+		id = &identity{
+			name:          name,
+			policy:        self.defaultPolicy,
+			reversePolicy: self.defaultReversePolicy,
+			maxSessions:   common.G.Server.MaxSessionsPerIdentity,
+		}
+		self.identities[name] = id
+	}
+	return id
+}
+
+// Reserve a session slot, maxSessions not greater than zero means no limit
+func (self *identityMgr) acquire(id *identity) (err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if id.maxSessions > 0 && id.sessions >= id.maxSessions {
+		err = fmt.Errorf("too many sessions, identity=[%s] sessions=%d max=%d", id.name, id.sessions, id.maxSessions)
+	} else {
+		id.sessions += 1
+	}
+	return err
+}
+
+func (self *identityMgr) release(id *identity) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	id.sessions -= 1
+}
+
+// Subject common name of the verified client certificate, empty while there is none
+func certIdentity(r *http.Request) (name string) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		subject := r.TLS.VerifiedChains[0][0].Subject
+		name = subject.CommonName
+		if name == "" {
+			name = subject.String()
+		}
+	}
+	return name
+}
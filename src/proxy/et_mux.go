@@ -0,0 +1,503 @@
+package proxy
+
+import (
+	"common"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	log "third/seelog"
+	"time"
+)
+
+// A multiplexed session carries many tcp streams over one tunnel session.
+// The session byte stream is a sequence of frames, sealed as a whole by the
+// session filter:
+//
+//	| type (1 byte) | stream id (4 bytes) | length (2 bytes) | payload |
+//
+// Open carries the destination address, data carries stream bytes, close
+// carries a status (2 bytes) followed by a reason. The status is 0 on normal
+// close, otherwise the http status a failed connect would be answered with.
+// From protocol version 3 on a dialed stream is acknowledged with an empty
+// opened frame, so the opener can tell success from a slow dial. From
+// FailureCodeVersion on a status other than 0 is followed by a failure code
+// (1 byte) before the reason.
+// Streams opened by the client have odd ids. From MuxWindowVersion on every
+// stream has a window of muxStreamWindow data frames in each direction: the
+// sender stops once it used up its window, the receiver hands back the frames
+// its connection took with a window frame (4 bytes of frame count), so a slow
+// connection stalls only its own stream. A peer without windows that overruns
+// the queue of a stream gets the stream closed.
+const (
+	muxFrameHeaderSize int64 = 7
+	muxFrameOpen       byte  = 1
+	muxFrameData       byte  = 2
+	muxFrameClose      byte  = 3
+	muxFrameOpened     byte  = 4
+	muxFrameWindow     byte  = 5
+	muxStreamWindow    int64 = DataQueueSize
+	MuxIdleTimeoutSec  int64 = 60
+	MuxOpenAckVersion  int   = 3
+	MuxWindowVersion   int   = 6
+)
+
+type iMuxHandler interface {
+	openStream(addr string) (conn *net.TCPConn, status int, err error)
+	closeStream(addr string)
+}
+
+type muxStream struct {
+	id     uint32
+	addr   string
+	conn   net.Conn
+	opened bool
+	sendQ  chan *dataBlock
+	done   chan bool
+	// called once the peer dialed the stream or refused it, nil while nobody waits
+	onOpen func(err error) error
+	// data frames the peer still takes, signaled on windowed as it hands frames back
+	credit   int64
+	windowed chan bool
+	// data frames written to conn and not handed back yet, owned by streamSendLoop
+	consumed int64
+}
+
+type muxProxy struct {
+	lock           sync.Mutex
+	sendLock       sync.Mutex
+	dnFilter       iFilter
+	handler        iMuxHandler
+	streams        map[uint32]*muxStream
+	nextId         uint32
+	pending        []byte
+	recvQ          chan *dataBlock
+	alive          atomic.Bool
+	ackOpen        bool
+	failureCodes   bool
+	windows        bool
+	idleTimeoutSec int64
+	idleSince      int64
+}
+
+// handler opens streams requested by the peer, nil refuses them. Sessions
+// without streams for idle_timeout_sec are no longer alive, 0 means never.
+// version is the protocol version both ends agreed on.
+func newMuxProxy(dn_filter iFilter, handler iMuxHandler, first_id uint32, idle_timeout_sec int64, version int) (mp *muxProxy) {
+	mp = &muxProxy{
+		dnFilter:       dn_filter,
+		handler:        handler,
+		streams:        make(map[uint32]*muxStream),
+		nextId:         first_id,
+		recvQ:          make(chan *dataBlock, DataQueueSize),
+		ackOpen:        version >= MuxOpenAckVersion,
+		failureCodes:   version >= FailureCodeVersion,
+		windows:        version >= MuxWindowVersion,
+		idleTimeoutSec: idle_timeout_sec,
+		idleSince:      common.GetCurrentTime(),
+	}
+	mp.alive.Store(true)
+	return mp
+}
+
+func (self *muxProxy) destroy() {
+	log.Infof("%s", self.String())
+	self.lock.Lock()
+	self.alive.Store(false)
+	ids := make([]uint32, 0, len(self.streams))
+	for id := range self.streams {
+		ids = append(ids, id)
+	}
+	self.lock.Unlock()
+	for _, id := range ids {
+		self.closeStream(id, 0, FailureUnknown, "session closed", false)
+	}
+	self.recvQ <- nil
+}
+
+// Once reported dead because of idle the session stays dead, no stream can be opened on it
+func (self *muxProxy) isAlive() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.alive.Load() && self.idleTimeoutSec > 0 && len(self.streams) == 0 &&
+		common.GetCurrentTime()-self.idleTimeoutSec*1000000 > self.idleSince {
+		log.Infof("mux session idle, %s", self.stringLocked())
+		self.alive.Store(false)
+	}
+	return self.alive.Load() || 0 != len(self.recvQ)
+}
+
+// Open a stream to addr through the session, the connection is owned by the session once passed in.
+// opened is called with the result of the dial, unless it is nil, and the stream carries data only
+// after it returns nil. A peer not acknowledging opens is taken as dialed at once.
+func (self *muxProxy) openStream(conn net.Conn, addr string, opened func(err error) error) (err error) {
+	self.lock.Lock()
+	if !self.alive.Load() {
+		self.lock.Unlock()
+		return fmt.Errorf("mux session not alive")
+	}
+	stream := self.newStream(self.nextId, addr)
+	stream.conn = conn
+	stream.opened = true
+	wait_ack := opened != nil && self.ackOpen
+	if wait_ack {
+		stream.onOpen = opened
+		opened = nil
+	}
+	self.nextId += 2
+	self.lock.Unlock()
+
+	log.Infof("open mux stream, id=%d addr=[%s] local=[%s]", stream.id, addr, conn.RemoteAddr().String())
+	self.sendFrame(muxFrameOpen, stream.id, []byte(addr))
+	if !wait_ack {
+		go self.startStream(stream, opened)
+	}
+	return err
+}
+
+// Start the stream once its opener accepted the result, a stream refused or not accepted gets its connection closed
+func (self *muxProxy) startStream(stream *muxStream, opened func(err error) error) {
+	if opened != nil {
+		if err := opened(nil); err != nil {
+			self.closeStream(stream.id, 0, FailureUnknown, err.Error(), true)
+			stream.conn.Close()
+			return
+		}
+	}
+	go self.streamSendLoop(stream)
+	go self.streamRecvLoop(stream)
+}
+
+// Take the waiting opener of the stream, nil while there is none or it was already told
+func (self *muxProxy) takeOpener(stream *muxStream) (opened func(err error) error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	opened, stream.onOpen = stream.onOpen, nil
+	return opened
+}
+
+// The stream failed before it was dialed, tell the opener why
+func (self *muxProxy) refuseOpen(stream *muxStream, err error) {
+	if opened := self.takeOpener(stream); opened != nil {
+		opened(err)
+		stream.conn.Close()
+	}
+}
+
+// Must be called with lock held
+func (self *muxProxy) newStream(id uint32, addr string) (stream *muxStream) {
+	stream = &muxStream{
+		id:       id,
+		addr:     addr,
+		sendQ:    make(chan *dataBlock, muxStreamWindow),
+		done:     make(chan bool),
+		credit:   muxStreamWindow,
+		windowed: make(chan bool, 1),
+	}
+	self.streams[id] = stream
+	return stream
+}
+
+// Whoever removes the stream from the map owns the close. A close from the peer
+// lets the queued data be written first, a local close drops it.
+func (self *muxProxy) closeStream(id uint32, status int, code byte, reason string, notify bool) {
+	self.lock.Lock()
+	stream := self.streams[id]
+	if stream == nil {
+		self.lock.Unlock()
+		return
+	}
+	delete(self.streams, id)
+	if len(self.streams) == 0 {
+		self.idleSince = common.GetCurrentTime()
+	}
+	opened := stream.opened
+	self.lock.Unlock()
+
+	log.Infof("close mux stream, id=%d addr=[%s] status=%d reason=[%s] notify=%t", id, stream.addr, status, reason, notify)
+	close(stream.done)
+	self.refuseOpen(stream, fmt.Errorf("mux stream closed, reason=[%s]", reason))
+	if notify {
+		payload := make([]byte, 2, 3+len(reason))
+		binary.BigEndian.PutUint16(payload, uint16(status))
+		if status != 0 && self.failureCodes {
+			payload = append(payload, code)
+		}
+		self.sendFrame(muxFrameClose, id, append(payload, reason...))
+	}
+	if opened && self.handler != nil {
+		self.handler.closeStream(stream.addr)
+	}
+}
+
+func (self *muxProxy) remoteCloseStream(id uint32, payload []byte) {
+	self.lock.Lock()
+	stream := self.streams[id]
+	if stream == nil {
+		self.lock.Unlock()
+		return
+	}
+	delete(self.streams, id)
+	if len(self.streams) == 0 {
+		self.idleSince = common.GetCurrentTime()
+	}
+	opened := stream.opened
+	self.lock.Unlock()
+
+	status, code, reason := 0, FailureUnknown, ""
+	if len(payload) >= 2 {
+		status, reason = int(binary.BigEndian.Uint16(payload)), string(payload[2:])
+	}
+	if status != 0 && self.failureCodes && len(payload) >= 3 {
+		code, reason = payload[2], string(payload[3:])
+	}
+	if status != 0 {
+		log.Warnf("mux stream refused by peer, id=%d addr=[%s] status=%d code=%d reason=[%s]", id, stream.addr, status, code, reason)
+		self.refuseOpen(stream, &sessionRefusedError{status: status, code: code, reason: reason})
+	} else {
+		log.Infof("mux stream closed by peer, id=%d addr=[%s]", id, stream.addr)
+		self.refuseOpen(stream, fmt.Errorf("mux stream closed by peer"))
+	}
+	// Only the frame dispatcher sends to sendQ and windowed, so it is safe to close them here
+	close(stream.sendQ)
+	close(stream.windowed)
+	if opened && self.handler != nil {
+		self.handler.closeStream(stream.addr)
+	}
+}
+
+// The peer asks for a stream, dial without blocking the frames of other streams
+func (self *muxProxy) acceptStream(id uint32, addr string) {
+	self.lock.Lock()
+	if _, exist := self.streams[id]; exist || !self.alive.Load() {
+		self.lock.Unlock()
+		log.Warnf("invalid mux stream open, id=%d addr=[%s]", id, addr)
+		return
+	}
+	stream := self.newStream(id, addr)
+	self.lock.Unlock()
+
+	if self.handler == nil {
+		self.closeStream(id, http.StatusNotImplemented, FailureUnknown, "open stream not supported", true)
+		return
+	}
+	go func() {
+		conn, status, err := self.handler.openStream(addr)
+		if err != nil {
+			self.closeStream(id, status, failureCode(err), err.Error(), true)
+			return
+		}
+		self.lock.Lock()
+		_, exist := self.streams[id]
+		if exist {
+			stream.conn = conn
+			stream.opened = true
+		}
+		self.lock.Unlock()
+		if !exist {
+			conn.Close()
+			self.handler.closeStream(addr)
+			return
+		}
+		if self.ackOpen {
+			self.sendFrame(muxFrameOpened, id, nil)
+		}
+		go self.streamSendLoop(stream)
+		go self.streamRecvLoop(stream)
+	}()
+}
+
+func (self *muxProxy) streamSendLoop(stream *muxStream) {
+	for {
+		select {
+		case dn, ok := <-stream.sendQ:
+			if !ok {
+				stream.conn.Close()
+				return
+			}
+			if _, err := stream.conn.Write(dn.data); err != nil {
+				log.Warnf("mux stream write fail, id=%d err=[%v]", stream.id, err)
+				self.closeStream(stream.id, 0, FailureUnknown, err.Error(), true)
+				stream.conn.Close()
+				return
+			}
+			self.handBackWindow(stream)
+		case <-stream.done:
+			stream.conn.Close()
+			return
+		}
+	}
+}
+
+// Hand the frames written to the connection back to the peer once half the window is used
+func (self *muxProxy) handBackWindow(stream *muxStream) {
+	if !self.windows {
+		return
+	}
+	stream.consumed += 1
+	if stream.consumed >= muxStreamWindow/2 {
+		self.sendFrame(muxFrameWindow, stream.id, binary.BigEndian.AppendUint32(nil, uint32(stream.consumed)))
+		stream.consumed = 0
+	}
+}
+
+// Wait until the peer takes another data frame, false once the stream is closed
+func (self *muxProxy) waitWindow(stream *muxStream) bool {
+	for self.windows && atomic.LoadInt64(&stream.credit) <= 0 {
+		select {
+		case _, ok := <-stream.windowed:
+			if !ok {
+				return false
+			}
+		case <-stream.done:
+			return false
+		}
+	}
+	return true
+}
+
+func (self *muxProxy) streamRecvLoop(stream *muxStream) {
+	for {
+		if !self.waitWindow(stream) {
+			return
+		}
+		data := make([]byte, self.dnFilter.dataBlockSize()-muxFrameHeaderSize)
+		read_ret, err := stream.conn.Read(data)
+		if read_ret > 0 {
+			atomic.AddInt64(&stream.credit, -1)
+			self.sendFrame(muxFrameData, stream.id, data[:read_ret])
+		}
+		if err != nil {
+			self.closeStream(stream.id, 0, FailureUnknown, err.Error(), true)
+			return
+		}
+	}
+}
+
+func (self *muxProxy) sendFrame(frame_type byte, id uint32, payload []byte) {
+	frame := make([]byte, muxFrameHeaderSize, muxFrameHeaderSize+int64(len(payload)))
+	frame[0] = frame_type
+	binary.BigEndian.PutUint32(frame[1:], id)
+	binary.BigEndian.PutUint16(frame[5:], uint16(len(payload)))
+	frame = append(frame, payload...)
+
+	self.sendLock.Lock()
+	defer self.sendLock.Unlock()
+	if !self.alive.Load() {
+		return
+	}
+	filtered_dn, err := self.dnFilter.onDataRecv(&dataBlock{data: frame})
+	if err != nil {
+		log.Warnf("filter data fail, err=[%v] %s", err, self.String())
+		self.alive.Store(false)
+	} else if filtered_dn != nil {
+		self.recvQ <- filtered_dn
+	}
+}
+
+// Data from the peer, dispatch the complete frames to their streams
+func (self *muxProxy) pushData(dn *dataBlock) {
+	filtered_dn, err := self.dnFilter.onDataSend(dn)
+	if err != nil {
+		log.Warnf("filter data fail, err=[%v] %s", err, self.String())
+		self.alive.Store(false)
+		return
+	} else if filtered_dn == nil {
+		return
+	}
+	self.pending = append(self.pending, filtered_dn.data...)
+	for int64(len(self.pending)) >= muxFrameHeaderSize {
+		frame_len := muxFrameHeaderSize + int64(binary.BigEndian.Uint16(self.pending[5:]))
+		if int64(len(self.pending)) < frame_len {
+			break
+		}
+		frame_type := self.pending[0]
+		id := binary.BigEndian.Uint32(self.pending[1:])
+		payload := append([]byte{}, self.pending[muxFrameHeaderSize:frame_len]...)
+		self.pending = self.pending[frame_len:]
+		self.dispatch(frame_type, id, payload)
+	}
+	if len(self.pending) == 0 {
+		self.pending = nil
+	}
+}
+
+func (self *muxProxy) dispatch(frame_type byte, id uint32, payload []byte) {
+	switch frame_type {
+	case muxFrameOpen:
+		self.acceptStream(id, string(payload))
+	case muxFrameData:
+		self.lock.Lock()
+		stream := self.streams[id]
+		self.lock.Unlock()
+		if stream != nil {
+			select {
+			case stream.sendQ <- &dataBlock{data: payload}:
+			case <-stream.done:
+			default:
+				log.Warnf("mux stream queue full, id=%d addr=[%s] size=%d windows=%t", id, stream.addr, muxStreamWindow, self.windows)
+				self.closeStream(id, 0, FailureUnknown, "stream queue full", true)
+			}
+		}
+	case muxFrameWindow:
+		self.lock.Lock()
+		stream := self.streams[id]
+		self.lock.Unlock()
+		if stream == nil {
+			return
+		} else if len(payload) != 4 {
+			log.Warnf("invalid mux window frame, id=%d len=%d", id, len(payload))
+			return
+		}
+		atomic.AddInt64(&stream.credit, int64(binary.BigEndian.Uint32(payload)))
+		select {
+		case stream.windowed <- true:
+		default:
+		}
+	case muxFrameOpened:
+		self.lock.Lock()
+		stream := self.streams[id]
+		self.lock.Unlock()
+		if stream == nil {
+			return
+		} else if opened := self.takeOpener(stream); opened != nil {
+			go self.startStream(stream, opened)
+		}
+	case muxFrameClose:
+		self.remoteCloseStream(id, payload)
+	default:
+		log.Warnf("invalid mux frame type, type=%d id=%d", frame_type, id)
+	}
+}
+
+func (self *muxProxy) popData(time_wait_us int64) (dn *dataBlock) {
+	select {
+	case dn = <-self.recvQ:
+	default:
+	}
+	if dn == nil && 0 != time_wait_us && (self.isAlive() || 0 < len(self.recvQ)) {
+		if 0 < time_wait_us {
+			timer := time.NewTicker((time.Duration)(time_wait_us) * time.Microsecond)
+			select {
+			case dn = <-self.recvQ:
+			case <-timer.C:
+			}
+		} else {
+			dn = <-self.recvQ
+		}
+	}
+	return dn
+}
+
+func (self *muxProxy) String() string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.stringLocked()
+}
+
+func (self *muxProxy) stringLocked() string {
+	return fmt.Sprintf("this=%p mux=true streams=%d alive=%t recvQLen=%d %s",
+		self, len(self.streams), self.alive.Load(), len(self.recvQ), self.dnFilter.String())
+}
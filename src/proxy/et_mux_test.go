@@ -0,0 +1,312 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type muxTestHandler struct {
+	status int
+	err    error
+	addrs  chan string
+}
+
+func (self *muxTestHandler) openStream(addr string) (conn *net.TCPConn, status int, err error) {
+	self.addrs <- addr
+	return nil, self.status, self.err
+}
+
+func (self *muxTestHandler) closeStream(addr string) {
+}
+
+func muxTestFrame(frame_type byte, id uint32, payload []byte) []byte {
+	frame := make([]byte, muxFrameHeaderSize, muxFrameHeaderSize+int64(len(payload)))
+	frame[0] = frame_type
+	binary.BigEndian.PutUint32(frame[1:], id)
+	binary.BigEndian.PutUint16(frame[5:], uint16(len(payload)))
+	return append(frame, payload...)
+}
+
+func muxTestClosePayload(status int, code []byte, reason string) []byte {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(status))
+	return append(append(payload, code...), reason...)
+}
+
+// Every frame sent by the session is one block of its queue while the filter is a dummy one
+func readMuxFrame(t *testing.T, mp *muxProxy) (frame_type byte, id uint32, payload []byte) {
+	dn := mp.popData(int64(2 * time.Second / time.Microsecond))
+	if dn == nil {
+		t.Fatalf("no frame sent")
+	}
+	if int64(len(dn.data)) < muxFrameHeaderSize ||
+		int64(len(dn.data)) != muxFrameHeaderSize+int64(binary.BigEndian.Uint16(dn.data[5:])) {
+		t.Fatalf("invalid frame, len=%d", len(dn.data))
+	}
+	return dn.data[0], binary.BigEndian.Uint32(dn.data[1:]), dn.data[muxFrameHeaderSize:]
+}
+
+func TestMuxOpenRefused(t *testing.T) {
+	cases := []struct {
+		name    string
+		version int
+		status  int
+		err     error
+		payload []byte
+	}{
+		{"denied", FailureCodeVersion, http.StatusForbidden, &destDeniedError{addr: "a", reason: "r"},
+			muxTestClosePayload(http.StatusForbidden, []byte{FailureDenied}, (&destDeniedError{addr: "a", reason: "r"}).Error())},
+		{"connection refused", FailureCodeVersion, http.StatusBadGateway, fmt.Errorf("dial fail, err=[%w]", syscall.ECONNREFUSED),
+			muxTestClosePayload(http.StatusBadGateway, []byte{FailureConnectionRefused}, "dial fail, err=[connection refused]")},
+		{"unknown failure", FailureCodeVersion, http.StatusTooManyRequests, fmt.Errorf("too many"),
+			muxTestClosePayload(http.StatusTooManyRequests, []byte{FailureUnknown}, "too many")},
+		{"peer without codes", MuxOpenAckVersion, http.StatusForbidden, &destDeniedError{addr: "a", reason: "r"},
+			muxTestClosePayload(http.StatusForbidden, nil, (&destDeniedError{addr: "a", reason: "r"}).Error())},
+	}
+	for _, c := range cases {
+		handler := &muxTestHandler{status: c.status, err: c.err, addrs: make(chan string, 1)}
+		mp := newMuxProxy(&dummyFilter{}, handler, 2, 0, c.version)
+		// the frame arrives one byte at a time
+		for _, b := range muxTestFrame(muxFrameOpen, 7, []byte("10.0.0.1:22")) {
+			mp.pushData(&dataBlock{data: []byte{b}})
+		}
+		if addr := <-handler.addrs; addr != "10.0.0.1:22" {
+			t.Fatalf("%s: addr=[%s]", c.name, addr)
+		}
+		frame_type, id, payload := readMuxFrame(t, mp)
+		if frame_type != muxFrameClose || id != 7 || string(payload) != string(c.payload) {
+			t.Fatalf("%s: type=%d id=%d payload=[%q] want payload=[%q]", c.name, frame_type, id, payload, c.payload)
+		}
+		mp.destroy()
+	}
+}
+
+func TestMuxRemoteClose(t *testing.T) {
+	cases := []struct {
+		name    string
+		version int
+		payload []byte
+		refused bool
+		status  int
+		code    byte
+		reason  string
+	}{
+		{"refused with code", FailureCodeVersion, muxTestClosePayload(http.StatusBadGateway, []byte{FailureNetworkUnreachable}, "unreachable"),
+			true, http.StatusBadGateway, FailureNetworkUnreachable, "unreachable"},
+		{"refused with code only", FailureCodeVersion, muxTestClosePayload(http.StatusForbidden, []byte{FailureDenied}, ""),
+			true, http.StatusForbidden, FailureDenied, ""},
+		{"refused by peer without codes", MuxOpenAckVersion, muxTestClosePayload(http.StatusForbidden, nil, "denied"),
+			true, http.StatusForbidden, FailureUnknown, "denied"},
+		{"refused without reason", FailureCodeVersion, muxTestClosePayload(http.StatusBadGateway, nil, ""),
+			true, http.StatusBadGateway, FailureUnknown, ""},
+		{"closed", FailureCodeVersion, muxTestClosePayload(0, nil, "eof"), false, 0, 0, ""},
+		{"closed without payload", FailureCodeVersion, nil, false, 0, 0, ""},
+	}
+	for _, c := range cases {
+		mp := newMuxProxy(&dummyFilter{}, nil, 1, 0, c.version)
+		local, remote := net.Pipe()
+		result := make(chan error, 1)
+		err := mp.openStream(local, "10.0.0.1:22", func(err error) error {
+			result <- err
+			return err
+		})
+		if err != nil {
+			t.Fatalf("%s: openStream fail, err=[%v]", c.name, err)
+		}
+		if frame_type, id, payload := readMuxFrame(t, mp); frame_type != muxFrameOpen || id != 1 || string(payload) != "10.0.0.1:22" {
+			t.Fatalf("%s: open frame type=%d id=%d payload=[%s]", c.name, frame_type, id, payload)
+		}
+		mp.pushData(&dataBlock{data: muxTestFrame(muxFrameClose, 1, c.payload)})
+		err = <-result
+		refused, ok := err.(*sessionRefusedError)
+		if ok != c.refused || err == nil {
+			t.Fatalf("%s: err=[%v] refused=%t", c.name, err, c.refused)
+		}
+		if ok && (refused.status != c.status || refused.code != c.code || refused.reason != c.reason) {
+			t.Fatalf("%s: status=%d code=%d reason=[%s] want status=%d code=%d reason=[%s]",
+				c.name, refused.status, refused.code, refused.reason, c.status, c.code, c.reason)
+		}
+		remote.Close()
+		mp.destroy()
+	}
+}
+
+// A stream of a peer without windows whose connection takes no data is closed, the frames of the others keep flowing
+func TestMuxStreamQueueFull(t *testing.T) {
+	mp := newMuxProxy(&dummyFilter{}, nil, 1, 0, 1)
+	local, remote := net.Pipe()
+	defer remote.Close()
+	if err := mp.openStream(local, "10.0.0.1:22", nil); err != nil {
+		t.Fatalf("openStream fail, err=[%v]", err)
+	}
+	readMuxFrame(t, mp)
+
+	done := make(chan bool)
+	go func() {
+		for i := int64(0); i < DataQueueSize+2; i++ {
+			mp.pushData(&dataBlock{data: muxTestFrame(muxFrameData, 1, []byte("data"))})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("frame reader blocked by a full stream queue")
+	}
+	frame_type, id, payload := readMuxFrame(t, mp)
+	if frame_type != muxFrameClose || id != 1 || string(payload) != string(muxTestClosePayload(0, nil, "stream queue full")) {
+		t.Fatalf("type=%d id=%d payload=[%q]", frame_type, id, payload)
+	}
+	mp.destroy()
+}
+
+func muxTestWindow(n uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, n)
+}
+
+// The sender stops once its window is used up and goes on with the frames handed back
+func TestMuxStreamWindowSend(t *testing.T) {
+	mp := newMuxProxy(&dummyFilter{}, nil, 1, 0, ProtocolVersion)
+	local, remote := net.Pipe()
+	defer remote.Close()
+	if err := mp.openStream(local, "10.0.0.1:22", nil); err != nil {
+		t.Fatalf("openStream fail, err=[%v]", err)
+	}
+	readMuxFrame(t, mp)
+	go func() {
+		for {
+			if _, err := remote.Write([]byte("x")); err != nil {
+				return
+			}
+		}
+	}()
+
+	cases := []struct {
+		name   string
+		id     uint32
+		window []byte
+		frames int64
+	}{
+		{"first window", 1, nil, muxStreamWindow},
+		{"frames handed back", 1, muxTestWindow(10), 10},
+		{"invalid window", 1, []byte{0, 10}, 0},
+		{"window of another stream", 3, muxTestWindow(10), 0},
+		{"rest of the window", 1, muxTestWindow(uint32(muxStreamWindow)), muxStreamWindow},
+	}
+	for _, c := range cases {
+		if c.window != nil {
+			mp.pushData(&dataBlock{data: muxTestFrame(muxFrameWindow, c.id, c.window)})
+		}
+		for i := int64(0); i < c.frames; i++ {
+			if frame_type, id, _ := readMuxFrame(t, mp); frame_type != muxFrameData || id != 1 {
+				t.Fatalf("%s: type=%d id=%d", c.name, frame_type, id)
+			}
+		}
+		if dn := mp.popData(int64(100 * time.Millisecond / time.Microsecond)); dn != nil {
+			t.Fatalf("%s: frame sent beyond the window, frame=[%q]", c.name, dn.data)
+		}
+	}
+	mp.destroy()
+}
+
+// The receiver keeps a slow stream open and hands back what its connection took
+func TestMuxStreamWindowRecv(t *testing.T) {
+	mp := newMuxProxy(&dummyFilter{}, nil, 1, 0, ProtocolVersion)
+	local, remote := net.Pipe()
+	defer remote.Close()
+	if err := mp.openStream(local, "10.0.0.1:22", nil); err != nil {
+		t.Fatalf("openStream fail, err=[%v]", err)
+	}
+	readMuxFrame(t, mp)
+	for i := int64(0); i < muxStreamWindow; i++ {
+		mp.pushData(&dataBlock{data: muxTestFrame(muxFrameData, 1, []byte("data"))})
+	}
+	if dn := mp.popData(int64(100 * time.Millisecond / time.Microsecond)); dn != nil {
+		t.Fatalf("frame sent before the connection took data, frame=[%q]", dn.data)
+	}
+	buf := make([]byte, 4)
+	for i := int64(0); i < muxStreamWindow/2; i++ {
+		if _, err := io.ReadFull(remote, buf); err != nil || string(buf) != "data" {
+			t.Fatalf("read fail, err=[%v] data=[%s]", err, buf)
+		}
+	}
+	frame_type, id, payload := readMuxFrame(t, mp)
+	if frame_type != muxFrameWindow || id != 1 || string(payload) != string(muxTestWindow(uint32(muxStreamWindow/2))) {
+		t.Fatalf("type=%d id=%d payload=[%q]", frame_type, id, payload)
+	}
+	mp.destroy()
+}
+
+// Streams opened, fed and closed from both ends while the session is destroyed, run with -race
+func TestMuxConcurrentDestroy(t *testing.T) {
+	mp := newMuxProxy(&dummyFilter{}, nil, 1, 0, ProtocolVersion)
+	drained := make(chan bool)
+	go func() {
+		defer close(drained)
+		for mp.isAlive() {
+			mp.popData(1000)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	var remotes []net.Conn
+	var remotes_lock sync.Mutex
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			local, remote := net.Pipe()
+			remotes_lock.Lock()
+			remotes = append(remotes, remote)
+			remotes_lock.Unlock()
+			if err := mp.openStream(local, "10.0.0.1:22", nil); err != nil {
+				local.Close()
+				return
+			}
+			go io.Copy(io.Discard, remote)
+			for j := 0; j < 20; j++ {
+				if _, err := remote.Write([]byte("data")); err != nil {
+					return
+				}
+				mp.isAlive()
+				_ = mp.String()
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 200; j++ {
+			id := uint32(j%8*2 + 1)
+			switch j % 4 {
+			case 0, 1:
+				mp.pushData(&dataBlock{data: muxTestFrame(muxFrameData, id, []byte("data"))})
+			case 2:
+				mp.pushData(&dataBlock{data: muxTestFrame(muxFrameWindow, id, muxTestWindow(1))})
+			case 3:
+				if j > 100 {
+					mp.pushData(&dataBlock{data: muxTestFrame(muxFrameClose, id, nil)})
+				}
+			}
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	mp.destroy()
+	wg.Wait()
+	remotes_lock.Lock()
+	for _, remote := range remotes {
+		remote.Close()
+	}
+	remotes_lock.Unlock()
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("session still alive after destroy, %s", mp.String())
+	}
+}
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"common"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+)
+
+// The connect request carries the protocol version of the client and what it
+// asks for: multiplexing, a stream transport, a filter chain and the largest
+// block of tcp data it takes. The server answers with its own version, what it
+// granted and what it supports, so either end can tell why a request is not
+// met. A peer sending no version is version 1, version 3 acknowledges the
+// streams of a multiplexed session once they are dialed. A reverse session is
+// multiplexed and needs version 3, its streams are opened by the server.
+// Version 4 signs the payload of data requests, from version 5 on a refused
+// connect or mux stream carries a failure code along with its reason. Version 6
+// gives every mux stream a window of frames.
+const (
+	ProtocolVersion    int   = 6
+	FailureCodeVersion int   = 5
+	MinProtocolVersion int   = 1
+	MinBlockSize       int64 = 1024
+)
+
+// What both ends agreed on at connect
+type sessionParams struct {
+	version       int
+	transport     string
+	filters       []string
+	compressLevel int
+	mux           bool
+	blockSize     int64
+	// address asked for by the client of a reverse session, the one listened on once granted
+	reverse string
+}
+
+type serverCapabilities struct {
+	Transports []string `json:"w"`
+	Filters    []string `json:"f"`
+	Mux        bool     `json:"m"`
+	BlockSize  int64    `json:"b"`
+}
+
+// 0 means DataBlockSize
+func checkBlockSize(size int64) (block_size int64, err error) {
+	if block_size = size; block_size == 0 {
+		block_size = DataBlockSize
+	} else if block_size < MinBlockSize || block_size > DataBlockSize {
+		err = fmt.Errorf("invalid block size, size=%d, must be %d to %d", size, MinBlockSize, DataBlockSize)
+	}
+	return block_size, err
+}
+
+func parseVersion(v string) (version int, err error) {
+	if v == "" {
+		return 1, err
+	}
+	if version, err = strconv.Atoi(v); err != nil || version < 1 {
+		err = fmt.Errorf("invalid protocol version, version=[%s]", v)
+	}
+	return version, err
+}
+
+func newServerCapabilities() (caps *serverCapabilities, err error) {
+	block_size, err := checkBlockSize(common.G.Server.MaxBlockSize)
+	if err != nil {
+		return caps, err
+	}
+	transports := []string{TransportPoll}
+	if common.G.Server.WebSocketEnable {
+		transports = append(transports, TransportWebSocket)
+	}
+	if common.G.Server.HTTP2Enable {
+		transports = append(transports, TransportHTTP2)
+	}
+	if common.G.Server.SplitEnable {
+		transports = append(transports, TransportSplit)
+	}
+	caps = &serverCapabilities{
+		Transports: transports,
+		Filters:    []string{FilterCompress, FilterEncrypt, FilterPadding, FilterBase64},
+		Mux:        true,
+		BlockSize:  block_size,
+	}
+	return caps, err
+}
+
+// What the server grants to the connect request of q, err tells the client why it is refused
+func (self *serverCapabilities) sessionParams(q url.Values) (params *sessionParams, err error) {
+	var filters []string
+	client_version, err := parseVersion(q.Get(QK_VERSION))
+	if err != nil {
+		return params, err
+	} else if client_version < MinProtocolVersion {
+		return params, fmt.Errorf("protocol version not supported, client=%d min=%d", client_version, MinProtocolVersion)
+	}
+	block_size := DataBlockSize
+	if s := q.Get(QK_MAX_BLOCK); s != "" {
+		if block_size, err = strconv.ParseInt(s, 10, 64); err != nil || block_size < MinBlockSize {
+			return params, fmt.Errorf("invalid block size, size=[%s] min=%d", s, MinBlockSize)
+		}
+	}
+	if filters, err = serverFilterChain(q); err != nil {
+		return params, err
+	}
+	params = &sessionParams{
+		version:   min(client_version, ProtocolVersion),
+		transport: TransportPoll,
+		filters:   filters,
+		mux:       q.Get(QK_MUX) != "",
+		blockSize: min(block_size, self.BlockSize),
+		reverse:   q.Get(QK_REVERSE),
+	}
+	if params.reverse != "" && (!params.mux || params.version < MuxOpenAckVersion) {
+		return nil, fmt.Errorf("reverse session needs multiplexing and protocol version %d, version=%d", MuxOpenAckVersion, params.version)
+	}
+	if hasFilter(filters, FilterCompress) {
+		params.compressLevel = compressLevel(common.G.Server.CompressionLevel)
+	}
+	if transport := q.Get(QK_TRANSPORT); transport != TransportPoll && slices.Contains(self.Transports, transport) {
+		params.transport = transport
+	}
+	return params, err
+}
+
+// What the server granted, a server without version grants what the flags of the response tell
+// and sends blocks of any size, blocks sent to it keep to the block size of the client
+func (self *clientContext) sessionParams(mux bool, cr *connectResponse) (params *sessionParams, err error) {
+	var filters []string
+	version := max(cr.Version, 1)
+	block_size := cr.BlockSize
+	if block_size == 0 {
+		block_size = self.blockSize
+	}
+	if version < MinProtocolVersion {
+		return params, fmt.Errorf("protocol version of server not supported, server=%d min=%d", version, MinProtocolVersion)
+	} else if mux && cr.Capabilities != nil && !cr.Capabilities.Mux {
+		return params, fmt.Errorf("server does not support multiplexing")
+	} else if block_size < MinBlockSize || block_size > self.blockSize {
+		return params, fmt.Errorf("invalid block size granted by server, size=%d max=%d", block_size, self.blockSize)
+	} else if filters, err = clientFilterChain(self.filters, cr); err != nil {
+		return params, err
+	}
+	params = &sessionParams{
+		version:   min(version, ProtocolVersion),
+		transport: TransportPoll,
+		filters:   filters,
+		mux:       mux,
+		blockSize: block_size,
+		reverse:   cr.Reverse,
+	}
+	if hasFilter(filters, FilterCompress) {
+		params.compressLevel = compressLevel(self.config.CompressionLevel)
+	}
+	if cr.Transport == TransportWebSocket || cr.Transport == TransportHTTP2 || cr.Transport == TransportSplit {
+		params.transport = cr.Transport
+	}
+	return params, err
+}
+
+func (self *sessionParams) String() string {
+	return fmt.Sprintf("version=%d transport=[%s] filters=[%s] mux=%t blockSize=%d reverse=[%s]",
+		self.version, self.transport, filterChainString(self.filters), self.mux, self.blockSize, self.reverse)
+}
@@ -5,15 +5,50 @@ import (
 )
 
 const (
-	QK_CONN_KEY = "c"
-	QK_ADDR     = "a"
-	QK_SEQ      = "s"
+	QK_CONN_KEY  = "c"
+	QK_ADDR      = "a"
+	QK_SEQ       = "s"
+	QK_HANDSHAKE = "h"
+	QK_AUTH_ID   = "i"
+	QK_TIMESTAMP = "t"
+	QK_SIGNATURE = "g"
+	QK_MUX       = "m"
+	QK_ACK       = "k"
+	QK_TRANSPORT = "w"
+	QK_PAYLOAD   = "p"
+	QK_COMPRESS  = "z"
+	QK_FILTERS   = "f"
+	// servers before version negotiation keep unknown keys as sent on the wire,
+	// these are sent under their own names so the signature still matches there
+	QK_VERSION   = "ver"
+	QK_MAX_BLOCK = "size"
+	QK_REVERSE   = "rev"
 
 	QP_DATA    = "d"
 	QP_CONNECT = "c"
+
+	TransportPoll           = "poll"
+	TransportWebSocket      = "websocket"
+	TransportHTTP2          = "h2"
+	TransportHTTP2Cleartext = "h2c"
+	TransportSplit          = "split"
 )
 
 const (
 	DataBlockSize int64 = math.MaxUint16
 	DataQueueSize int64 = 100
+
+	DefaultServerPipelineWindow int64 = 16
+	DefaultClientPipelineWindow int64 = 1
 )
+
+// Max data requests in flight of one session, never more than the queues hold
+func pipelineWindow(window int64, default_window int64) int64 {
+	if window <= 0 {
+		window = default_window
+	}
+	if window > DataQueueSize {
+		window = DataQueueSize
+	}
+	return window
+}
@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	log "third/seelog"
+	"time"
+)
+
+// A reverse session asks the tunnel server to listen at connect, every
+// connection accepted there is pushed back to the client as a stream of the
+// session and the client dials the dest of its listener. The listener of the
+// server closes with the session, the client connects the session again
+// while it dies.
+//
+// A reverse bind rule looks like a destination rule, <host>[:<ports>], but host
+// is a cidr, an ip or *, matching the ip the client asks to listen on. A client
+// asking for no host listens on all interfaces, matched as 0.0.0.0. A client
+// asking for port 0 gets the first free port of the rules, a rule of any port
+// leaves it to the system. Reverse sessions are refused while there is no rule.
+const (
+	ReverseDialTimeoutSec int64 = 10
+	ReverseRetryMinSec    int64 = 1
+	ReverseRetryMaxSec    int64 = 30
+)
+
+type reversePolicy struct {
+	allow []*destRule
+}
+
+// Returned while the address is refused by the policy, not while it just can not be listened on
+type reverseDeniedError struct {
+	addr   string
+	reason string
+}
+
+// Opens the streams pushed by the tunnel server, every one to the dest of the listener
+type reverseHandler struct {
+	clientServer *clientServer
+}
+
+func (self *reverseDeniedError) Error() string {
+	return fmt.Sprintf("reverse bind denied by policy, addr=[%s] reason=[%s]", self.addr, self.reason)
+}
+
+func newReversePolicy(allow []string) (rp *reversePolicy, err error) {
+	rp_impl := &reversePolicy{}
+	if rp_impl.allow, err = parseDestRules(allow); err != nil {
+		return rp, err
+	}
+	for _, rule := range rp_impl.allow {
+		if rule.network == nil && rule.glob != "*" {
+			return rp, fmt.Errorf("invalid reverse bind rule, host must be a cidr, an ip or *, rule=[%s]", rule.text)
+		}
+	}
+	rp = rp_impl
+	return rp, err
+}
+
+// Listen on addr while the policy allows it, port 0 takes a port of the matching rules
+func (self *reversePolicy) listen(addr string) (listener *net.TCPListener, err error) {
+	host, port_str, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reverse bind address, err=[%v] addr=[%s]", err, addr)
+	}
+	port, err := strconv.Atoi(port_str)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid reverse bind port, addr=[%s]", addr)
+	}
+	var listen_ip net.IP
+	ip := net.IPv4zero
+	if host != "" {
+		if listen_ip = net.ParseIP(host); listen_ip == nil {
+			return nil, &reverseDeniedError{addr: addr, reason: "host is not an ip"}
+		}
+		ip = listen_ip
+	}
+
+	var rules []*destRule
+	for _, rule := range self.allow {
+		if (rule.network == nil || rule.network.Contains(ip)) && (port == 0 || rule.matchPort(port)) {
+			rules = append(rules, rule)
+		}
+	}
+	if len(self.allow) == 0 {
+		return nil, &reverseDeniedError{addr: addr, reason: "reverse tunnels not allowed"}
+	} else if len(rules) == 0 {
+		return nil, &reverseDeniedError{addr: addr, reason: "not match any allow rule"}
+	}
+
+	if port != 0 {
+		return net.ListenTCP("tcp", &net.TCPAddr{IP: listen_ip, Port: port})
+	}
+	for _, rule := range rules {
+		if rule.portLow == 0 && rule.portHigh == 65535 {
+			if listener, err = net.ListenTCP("tcp", &net.TCPAddr{IP: listen_ip}); err == nil {
+				return listener, err
+			}
+			continue
+		}
+		for p := max(rule.portLow, 1); p <= rule.portHigh; p++ {
+			if listener, err = net.ListenTCP("tcp", &net.TCPAddr{IP: listen_ip, Port: p}); err == nil {
+				return listener, err
+			}
+		}
+	}
+	return nil, fmt.Errorf("no free port, err=[%v] addr=[%s]", err, addr)
+}
+
+func (self *reversePolicy) String() string {
+	texts := make([]string, 0, len(self.allow))
+	for _, rule := range self.allow {
+		texts = append(texts, rule.text)
+	}
+	return strings.Join(texts, ",")
+}
+
+// Listen for the reverse session of id, status is the http status to report on failure
+func (self *proxyServer) listenReverse(id *identity, remote string, addr string) (listener *net.TCPListener, status int, err error) {
+	listener, err = id.reversePolicy.listen(addr)
+	if denied, ok := err.(*reverseDeniedError); ok {
+		log.Warnf("audit: reverse listen denied, identity=[%s] remote=[%s] addr=[%s] reason=[%s]", id.name, remote, addr, denied.reason)
+		return nil, http.StatusForbidden, err
+	} else if err != nil {
+		log.Warnf("reverse listen fail, err=[%v] identity=[%s] remote=[%s] addr=[%s]", err, id.name, remote, addr)
+		return nil, http.StatusConflict, fmt.Errorf("reverse listen fail, err=[%v]", err)
+	}
+	log.Infof("audit: reverse listen allowed, identity=[%s] remote=[%s] addr=[%s] listen=[%s]", id.name, remote, addr, listener.Addr().String())
+	return listener, http.StatusOK, err
+}
+
+// Every connection accepted is pushed to the client as a stream until the listener closes with the session
+func (self *proxyServer) serveReverse(id *identity, remote string, mux *muxProxy, listener *net.TCPListener) {
+	listen := listener.Addr().String()
+	for {
+		conn, err := listener.AcceptTCP()
+		if err != nil {
+			log.Infof("reverse listener closed, err=[%v] identity=[%s] remote=[%s] listen=[%s]", err, id.name, remote, listen)
+			return
+		}
+		peer := conn.RemoteAddr().String()
+		if err = self.identities.acquire(id); err != nil {
+			log.Warnf("audit: reverse connection refused, err=[%v] remote=[%s] listen=[%s] peer=[%s]", err, remote, listen, peer)
+			conn.Close()
+			continue
+		}
+		log.Infof("audit: reverse connection accepted, identity=[%s] remote=[%s] listen=[%s] peer=[%s]", id.name, remote, listen, peer)
+		err = mux.openStream(conn, peer, func(err error) error {
+			if err != nil {
+				log.Warnf("reverse stream refused by client, err=[%v] listen=[%s] peer=[%s]", err, listen, peer)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Warnf("open reverse stream fail, err=[%v] listen=[%s] peer=[%s]", err, listen, peer)
+			self.identities.release(id)
+			conn.Close()
+			listener.Close()
+			return
+		}
+	}
+}
+
+// The session is connected again once it dies, the tunnel server listens while it lives
+func (self *clientServer) serveReverse() {
+	handler := &reverseHandler{clientServer: self}
+	backoff := ReverseRetryMinSec
+	for {
+		ts, err := newMuxTCPServer(self.getContext(), self.bindAddress, handler)
+		if err != nil {
+			self.setState(ListenerFailed, err)
+			self.setBound("")
+			log.Warnf("reverse session fail, err=[%v] retry=%ds %s", err, backoff, self.String())
+			time.Sleep(time.Duration(backoff) * time.Second)
+			backoff = min(backoff*2, ReverseRetryMaxSec)
+			continue
+		}
+		backoff = ReverseRetryMinSec
+		self.setState(ListenerListening, nil)
+		self.setBound(ts.httpClient.sessionParams().reverse)
+		log.Infof("reverse listen succ, %s", self.String())
+		for ts.httpClient.isAlive() && ts.tcpProxy.isAlive() {
+			time.Sleep(time.Second)
+		}
+		self.setState(ListenerFailed, fmt.Errorf("reverse session closed"))
+		log.Warnf("reverse session closed, %s", self.String())
+	}
+}
+
+func (self *reverseHandler) openStream(addr string) (conn *net.TCPConn, status int, err error) {
+	cs := self.clientServer
+	atomic.AddInt64(&cs.accepted, 1)
+	tcp_conn, err := net.DialTimeout("tcp", cs.remoteAddress, time.Duration(ReverseDialTimeoutSec)*time.Second)
+	if err != nil {
+		log.Warnf("reverse dial fail, err=[%v] dest=[%s] peer=[%s]", err, cs.remoteAddress, addr)
+		cs.tunnelFailed(err)
+		return nil, http.StatusBadGateway, fmt.Errorf("dial destination fail, err=[%w]", err)
+	}
+	atomic.AddInt64(&cs.active, 1)
+	log.Infof("reverse connect, dest=[%s] peer=[%s]", cs.remoteAddress, addr)
+	return tcp_conn.(*net.TCPConn), http.StatusOK, err
+}
+
+func (self *reverseHandler) closeStream(addr string) {
+	atomic.AddInt64(&self.clientServer.active, -1)
+}
@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	log "third/seelog"
+	"time"
+)
+
+// The listener of socks5 mode (RFC 1928) takes the destination of every
+// connection from its CONNECT request, IPv4, IPv6 or a domain name resolved
+// by the tunnel server. While client.ListenUser is set clients must log in
+// with username and password (RFC 1929). The reply waits for the tunnel
+// server to dial, its failures are answered with the matching reply code.
+const (
+	socks5Version            byte = 5
+	socks5AuthVersion        byte = 1
+	socks5MethodNone         byte = 0
+	socks5MethodPassword     byte = 2
+	socks5MethodNoAcceptable byte = 0xff
+	socks5CmdConnect         byte = 1
+	socks5AddrIPv4           byte = 1
+	socks5AddrDomain         byte = 3
+	socks5AddrIPv6           byte = 4
+
+	socks5ReplySucceeded           byte = 0
+	socks5ReplyFailure             byte = 1
+	socks5ReplyNotAllowed          byte = 2
+	socks5ReplyNetworkUnreachable  byte = 3
+	socks5ReplyHostUnreachable     byte = 4
+	socks5ReplyConnectionRefused   byte = 5
+	socks5ReplyCommandNotSupported byte = 7
+	socks5ReplyAddressNotSupported byte = 8
+
+	Socks5HandshakeTimeoutSec int64 = 10
+)
+
+// Every CONNECT is a tunnel of its own, or a stream of the mux session
+func (self *clientServer) serveSocks5(conn net.Conn) {
+	ctx := self.getContext()
+	local := conn.RemoteAddr().String()
+	dest, err := socks5Handshake(conn, ctx.listenUser, ctx.listenPassword)
+	if err != nil {
+		log.Warnf("socks5 handshake fail, err=[%v] local=[%s]", err, local)
+		conn.Close()
+		return
+	}
+	log.Infof("socks5 connect, dest=[%s] local=[%s]", dest, local)
+	self.openTunnel(conn, dest, func(err error) error {
+		reply := socks5ReplyCode(err)
+		if err != nil {
+			log.Warnf("socks5 connect fail, err=[%v] reply=%d dest=[%s] local=[%s]", err, reply, dest, local)
+		}
+		return writeSocks5Reply(conn, reply)
+	})
+}
+
+// Read the greeting and the request, dest is the host:port asked for
+func socks5Handshake(conn net.Conn, user string, password string) (dest string, err error) {
+	conn.SetDeadline(time.Now().Add(time.Duration(Socks5HandshakeTimeoutSec) * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	head := make([]byte, 2)
+	if _, err = io.ReadFull(conn, head); err != nil {
+		return dest, fmt.Errorf("read greeting fail, err=[%v]", err)
+	} else if head[0] != socks5Version {
+		return dest, fmt.Errorf("invalid socks version, version=%d", head[0])
+	}
+	methods := make([]byte, head[1])
+	if _, err = io.ReadFull(conn, methods); err != nil {
+		return dest, fmt.Errorf("read greeting fail, err=[%v]", err)
+	}
+	method := socks5MethodNone
+	if user != "" {
+		method = socks5MethodPassword
+	}
+	if !slices.Contains(methods, method) {
+		conn.Write([]byte{socks5Version, socks5MethodNoAcceptable})
+		return dest, fmt.Errorf("no acceptable auth method, methods=%v", methods)
+	} else if _, err = conn.Write([]byte{socks5Version, method}); err != nil {
+		return dest, fmt.Errorf("write method fail, err=[%v]", err)
+	} else if method == socks5MethodPassword {
+		if err = socks5Authenticate(conn, user, password); err != nil {
+			return dest, err
+		}
+	}
+
+	// | version | command | reserved | address type | address | port (2 bytes) |
+	req := make([]byte, 4)
+	if _, err = io.ReadFull(conn, req); err != nil {
+		return dest, fmt.Errorf("read request fail, err=[%v]", err)
+	} else if req[0] != socks5Version {
+		return dest, fmt.Errorf("invalid socks version, version=%d", req[0])
+	}
+	var host string
+	switch req[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make([]byte, net.IPv4len)
+		if req[3] == socks5AddrIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err = io.ReadFull(conn, ip); err != nil {
+			return dest, fmt.Errorf("read request fail, err=[%v]", err)
+		}
+		host = net.IP(ip).String()
+	case socks5AddrDomain:
+		name := make([]byte, 1)
+		if _, err = io.ReadFull(conn, name); err != nil {
+			return dest, fmt.Errorf("read request fail, err=[%v]", err)
+		}
+		name = make([]byte, name[0])
+		if _, err = io.ReadFull(conn, name); err != nil {
+			return dest, fmt.Errorf("read request fail, err=[%v]", err)
+		}
+		host = string(name)
+	default:
+		writeSocks5Reply(conn, socks5ReplyAddressNotSupported)
+		return dest, fmt.Errorf("address type not supported, type=%d", req[3])
+	}
+	port := make([]byte, 2)
+	if _, err = io.ReadFull(conn, port); err != nil {
+		return dest, fmt.Errorf("read request fail, err=[%v]", err)
+	}
+	dest = net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	if req[1] != socks5CmdConnect {
+		writeSocks5Reply(conn, socks5ReplyCommandNotSupported)
+		return dest, fmt.Errorf("command not supported, command=%d dest=[%s]", req[1], dest)
+	}
+	return dest, err
+}
+
+// | version | username length | username | password length | password |
+func socks5Authenticate(conn net.Conn, user string, password string) (err error) {
+	head := make([]byte, 2)
+	if _, err = io.ReadFull(conn, head); err != nil {
+		return fmt.Errorf("read auth request fail, err=[%v]", err)
+	} else if head[0] != socks5AuthVersion {
+		return fmt.Errorf("invalid auth version, version=%d", head[0])
+	}
+	req_user := make([]byte, head[1])
+	if _, err = io.ReadFull(conn, req_user); err != nil {
+		return fmt.Errorf("read auth request fail, err=[%v]", err)
+	}
+	req_password := make([]byte, 1)
+	if _, err = io.ReadFull(conn, req_password); err != nil {
+		return fmt.Errorf("read auth request fail, err=[%v]", err)
+	}
+	req_password = make([]byte, req_password[0])
+	if _, err = io.ReadFull(conn, req_password); err != nil {
+		return fmt.Errorf("read auth request fail, err=[%v]", err)
+	}
+	if subtle.ConstantTimeCompare(req_user, []byte(user)) != 1 ||
+		subtle.ConstantTimeCompare(req_password, []byte(password)) != 1 {
+		conn.Write([]byte{socks5AuthVersion, 1})
+		return fmt.Errorf("auth fail, user=[%s]", req_user)
+	}
+	_, err = conn.Write([]byte{socks5AuthVersion, 0})
+	return err
+}
+
+// The tunnel server is not told the address it dialed from, the reply carries 0.0.0.0:0
+func writeSocks5Reply(conn net.Conn, reply byte) (err error) {
+	_, err = conn.Write([]byte{socks5Version, reply, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// The reply follows the failure code of the tunnel server. A server older than
+// FailureCodeVersion tells only the status, 403 for a destination denied by the
+// policy and 502 for one it could not resolve or dial.
+func socks5ReplyCode(err error) byte {
+	refused, ok := err.(*sessionRefusedError)
+	switch {
+	case err == nil:
+		return socks5ReplySucceeded
+	case !ok:
+		return socks5ReplyFailure
+	case refused.code == FailureDenied || refused.status == http.StatusForbidden:
+		return socks5ReplyNotAllowed
+	case refused.code == FailureConnectionRefused:
+		return socks5ReplyConnectionRefused
+	case refused.code == FailureNetworkUnreachable:
+		return socks5ReplyNetworkUnreachable
+	case refused.code == FailureHostUnreachable:
+		return socks5ReplyHostUnreachable
+	case refused.code == FailureUnknown && refused.status == http.StatusBadGateway:
+		return socks5ReplyHostUnreachable
+	}
+	return socks5ReplyFailure
+}
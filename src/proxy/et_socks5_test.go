@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// The client side sends its whole script and closes its write half, the replies are read as they come
+func runSocks5Handshake(t *testing.T, script []byte, user string, password string) (dest string, replies []byte, err error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen fail, err=[%v]", err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial fail, err=[%v]", err)
+	}
+	defer client.Close()
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("accept fail, err=[%v]", err)
+	}
+	read := make(chan []byte)
+	go func() {
+		client.Write(script)
+		client.(*net.TCPConn).CloseWrite()
+		replies, _ := io.ReadAll(client)
+		read <- replies
+	}()
+	dest, err = socks5Handshake(server, user, password)
+	server.Close()
+	replies = <-read
+	return dest, replies, err
+}
+
+func TestSocks5Handshake(t *testing.T) {
+	refused := func(reply byte) []byte {
+		return []byte{socks5Version, reply, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0}
+	}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	no_auth := []byte{5, 1, 0}
+	password_auth := []byte{5, 2, 0, 2}
+	cases := []struct {
+		name     string
+		user     string
+		password string
+		script   []byte
+		valid    bool
+		dest     string
+		replies  []byte
+	}{
+		{"ipv4", "", "", join(no_auth, []byte{5, 1, 0, 1, 10, 0, 0, 1, 0, 22}), true, "10.0.0.1:22", []byte{5, 0}},
+		{"ipv6", "", "", join(no_auth, []byte{5, 1, 0, 4}, net.ParseIP("fd00::1"), []byte{1, 0xbb}), true, "[fd00::1]:443", []byte{5, 0}},
+		{"domain", "", "", join(no_auth, []byte{5, 1, 0, 3, 11}, []byte("example.com"), []byte{0, 80}), true, "example.com:80", []byte{5, 0}},
+		{"password", "user", "secret", join(password_auth, []byte{1, 4}, []byte("user"), []byte{6}, []byte("secret"),
+			[]byte{5, 1, 0, 1, 10, 0, 0, 1, 0, 22}), true, "10.0.0.1:22", []byte{5, 2, 1, 0}},
+		{"wrong password", "user", "secret", join(password_auth, []byte{1, 4}, []byte("user"), []byte{5}, []byte("guess")),
+			false, "", []byte{5, 2, 1, 1}},
+		{"wrong auth version", "user", "secret", join(password_auth, []byte{5, 4}), false, "", []byte{5, 2}},
+		{"password not offered", "user", "secret", no_auth, false, "", []byte{5, 0xff}},
+		{"socks4 greeting", "", "", []byte{4, 1, 0}, false, "", nil},
+		{"socks4 request", "", "", join(no_auth, []byte{4, 1, 0, 1}), false, "", []byte{5, 0}},
+		{"bind command", "", "", join(no_auth, []byte{5, 2, 0, 1, 10, 0, 0, 1, 0, 22}), false, "10.0.0.1:22",
+			join([]byte{5, 0}, refused(socks5ReplyCommandNotSupported))},
+		{"unknown address type", "", "", join(no_auth, []byte{5, 1, 0, 9}), false, "",
+			join([]byte{5, 0}, refused(socks5ReplyAddressNotSupported))},
+		{"truncated greeting", "", "", []byte{5, 2, 0}, false, "", nil},
+		{"truncated request", "", "", join(no_auth, []byte{5, 1, 0, 1, 10, 0}), false, "", []byte{5, 0}},
+	}
+	for _, c := range cases {
+		dest, replies, err := runSocks5Handshake(t, c.script, c.user, c.password)
+		if (err == nil) != c.valid {
+			t.Fatalf("%s: err=[%v] valid=%t", c.name, err, c.valid)
+		}
+		if dest != c.dest || !bytes.Equal(replies, c.replies) {
+			t.Fatalf("%s: dest=[%s] replies=%v want dest=[%s] replies=%v", c.name, dest, replies, c.dest, c.replies)
+		}
+	}
+}
+
+func TestSocks5ReplyCode(t *testing.T) {
+	cases := []struct {
+		name  string
+		err   error
+		reply byte
+	}{
+		{"connected", nil, socks5ReplySucceeded},
+		{"tunnel error", fmt.Errorf("connect fail"), socks5ReplyFailure},
+		{"denied", &sessionRefusedError{status: http.StatusForbidden, code: FailureDenied}, socks5ReplyNotAllowed},
+		{"connection refused", &sessionRefusedError{status: http.StatusBadGateway, code: FailureConnectionRefused}, socks5ReplyConnectionRefused},
+		{"network unreachable", &sessionRefusedError{status: http.StatusBadGateway, code: FailureNetworkUnreachable}, socks5ReplyNetworkUnreachable},
+		{"host unreachable", &sessionRefusedError{status: http.StatusBadGateway, code: FailureHostUnreachable}, socks5ReplyHostUnreachable},
+		{"other refusal", &sessionRefusedError{status: http.StatusTooManyRequests}, socks5ReplyFailure},
+		{"old server denied", &sessionRefusedError{status: http.StatusForbidden}, socks5ReplyNotAllowed},
+		{"old server dial fail", &sessionRefusedError{status: http.StatusBadGateway}, socks5ReplyHostUnreachable},
+	}
+	for _, c := range cases {
+		if reply := socks5ReplyCode(c.err); reply != c.reply {
+			t.Fatalf("%s: reply=%d want=%d", c.name, reply, c.reply)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	log "third/seelog"
+	"time"
+)
+
+// The split transport streams downstream data in the response of one long
+// lived request, as the frames of the http2 transport. Upstream data goes in
+// short upload requests sent one at a time, numbered so a retried upload is
+// applied once. Uploads never wait for the download, and the client answers
+// a ping of the download with an empty upload.
+type splitClientStream struct {
+	hc        *http.Client
+	wire      *wireFormat
+	uploadURL func(seq int64, data []byte) string
+	body      io.ReadCloser
+	cancel    context.CancelFunc
+	retry     int64
+	lock      sync.Mutex
+	seq       int64
+	closed    int32
+	closeOnce sync.Once
+	header    [wireFrameHeaderSize]byte
+}
+
+type splitServerStream struct {
+	down      *httpStream
+	lock      sync.Mutex
+	seq       int64
+	uploads   chan []byte
+	done      chan bool
+	closeOnce sync.Once
+}
+
+// upload_url signs the upload of a seq, uploads failing in transport or with 5xx are retried
+func dialSplitStream(hc *http.Client, download_url string, upload_url func(seq int64, data []byte) string, wire *wireFormat, retry int64) (ss *splitClientStream, err error) {
+	req, _ := http.NewRequest(http.MethodGet, download_url, nil)
+	wire.setRequestHeaders(req, false)
+	res, cancel, err := doStreamRequest(hc, req)
+	if err != nil {
+		return ss, fmt.Errorf("split download request fail at %s, err=[%v]", failedBy(err, nil), err)
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		cancel()
+		return ss, fmt.Errorf("split download refused by %s, status=[%s]", failedBy(nil, res), res.Status)
+	}
+	ss = &splitClientStream{
+		hc:        hc,
+		wire:      wire,
+		uploadURL: upload_url,
+		body:      res.Body,
+		cancel:    cancel,
+		retry:     retry,
+	}
+	return ss, err
+}
+
+func (self *splitClientStream) readBlock() (data []byte, err error) {
+	for {
+		frame_type, payload, err := readStreamFrame(self.body, self.header[:])
+		if err != nil {
+			return data, err
+		}
+		switch frame_type {
+		case wireFrameData:
+			return payload, err
+		case streamFramePing:
+			go self.pong()
+		}
+	}
+}
+
+func (self *splitClientStream) writeBlock(data []byte) (err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.upload(data)
+}
+
+func (self *splitClientStream) ping() (err error) {
+	return self.writeBlock(nil)
+}
+
+// An upload in progress keeps the session alive as well, no need to wait for it
+func (self *splitClientStream) pong() {
+	if self.lock.TryLock() {
+		defer self.lock.Unlock()
+		if err := self.upload(nil); err != nil {
+			log.Warnf("split pong fail, err=[%v]", err)
+		}
+	}
+}
+
+// Must be called with lock held
+func (self *splitClientStream) upload(data []byte) (err error) {
+	self.seq += 1
+	body := self.wire.encodeBody(data)
+	backoff := time.Duration(RetryBackoffMinMs) * time.Millisecond
+	for attempts := int64(1); ; attempts++ {
+		if atomic.LoadInt32(&self.closed) != 0 {
+			return io.ErrClosedPipe
+		}
+		req, _ := http.NewRequest(http.MethodPost, self.uploadURL(self.seq, data), bytes.NewReader(body))
+		self.wire.setRequestHeaders(req, true)
+		res, tmp_err := self.hc.Do(req)
+		failed_by := failedBy(tmp_err, res)
+		retryable := (tmp_err != nil)
+		if res != nil {
+			io.Copy(io.Discard, io.LimitReader(res.Body, 1024))
+			res.Body.Close()
+			if res.StatusCode == http.StatusOK {
+				return nil
+			}
+			retryable = (res.StatusCode >= http.StatusInternalServerError)
+			tmp_err = fmt.Errorf("status=[%s]", res.Status)
+		}
+		if !retryable || attempts > self.retry {
+			return fmt.Errorf("split upload fail at %s, err=[%v] seq=%d attempts=%d", failed_by, tmp_err, self.seq, attempts)
+		}
+		log.Warnf("split upload fail at %s, will retry, err=[%v] seq=%d attempts=%d backoff=%v", failed_by, tmp_err, self.seq, attempts, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > time.Duration(RetryBackoffMaxMs)*time.Millisecond {
+			backoff = time.Duration(RetryBackoffMaxMs) * time.Millisecond
+		}
+	}
+}
+
+func (self *splitClientStream) close() {
+	self.closeOnce.Do(func() {
+		atomic.StoreInt32(&self.closed, 1)
+		self.body.Close()
+		self.cancel()
+	})
+}
+
+func newSplitServerStream() (ss *splitServerStream) {
+	ss = &splitServerStream{
+		uploads: make(chan []byte, DataQueueSize),
+		done:    make(chan bool),
+	}
+	return ss
+}
+
+// Uploads are taken once the download is open, so none can arrive before
+func (self *splitServerStream) open(down *httpStream) {
+	self.down = down
+}
+
+// A seq already taken is a retry and ignored, a gap means an upload was lost
+func (self *splitServerStream) push(seq int64, data []byte) (err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if seq <= self.seq {
+		log.Infof("retried split upload, ignored, seq=%d current=%d", seq, self.seq)
+		return err
+	} else if seq != self.seq+1 {
+		return fmt.Errorf("invalid split upload seq, current=%d input=%d", self.seq, seq)
+	}
+	select {
+	case self.uploads <- data:
+		self.seq = seq
+	case <-self.done:
+		err = fmt.Errorf("split stream closed")
+	}
+	return err
+}
+
+// An empty upload is the pong of a ping
+func (self *splitServerStream) readBlock() (data []byte, err error) {
+	select {
+	case data = <-self.uploads:
+	case <-self.done:
+		err = io.EOF
+	}
+	return data, err
+}
+
+func (self *splitServerStream) writeBlock(data []byte) (err error) {
+	return self.down.writeBlock(data)
+}
+
+func (self *splitServerStream) ping() (err error) {
+	return self.down.ping()
+}
+
+func (self *splitServerStream) close() {
+	self.closeOnce.Do(func() {
+		close(self.done)
+		if self.down != nil {
+			self.down.close()
+		}
+	})
+}
@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A stream transport carries the sealed byte stream of a session over one full
+// duplex channel instead of one request per block. The websocket transport
+// sends binary messages. The http2 transport sends one request whose body
+// streams to the server while its response streams back, both cut into wire
+// frames:
+//
+//	| type (1 byte) | length (2 bytes) | payload |
+//
+// with ping and pong frames added to keep an idle session alive.
+const (
+	streamFramePing     byte  = 2
+	streamFramePong     byte  = 3
+	StreamTimeoutSec    int64 = 10
+	StreamRetryAfterSec int64 = 300
+)
+
+type iStreamConn interface {
+	readBlock() (data []byte, err error) // nil data is a pong, io.EOF once the peer closes
+	writeBlock(data []byte) (err error)
+	ping() (err error)
+	close()
+}
+
+type httpStream struct {
+	r         io.Reader
+	w         io.Writer
+	flush     func() error
+	closer    func()
+	wire      *wireFormat
+	lock      sync.Mutex
+	closed    bool
+	closeOnce sync.Once
+	header    [wireFrameHeaderSize]byte
+}
+
+// Cancel the request while no response arrives in StreamTimeoutSec, an intermediary that
+// blocks the transport may never answer. The context must not be canceled after success.
+func doStreamRequest(hc *http.Client, req *http.Request) (res *http.Response, cancel context.CancelFunc, err error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(time.Duration(StreamTimeoutSec)*time.Second, cancel)
+	if res, err = hc.Do(req.WithContext(ctx)); err != nil {
+		cancel()
+	} else if !timer.Stop() {
+		res.Body.Close()
+		res, err = nil, fmt.Errorf("stream request timeout")
+	}
+	return res, cancel, err
+}
+
+// The request body streams blocks to the server, the response streams them back,
+// only taken while both ends talk http2
+func dialHTTPStream(hc *http.Client, u string, wire *wireFormat) (hs *httpStream, err error) {
+	pr, pw := io.Pipe()
+	req, _ := http.NewRequest(http.MethodPost, u, pr)
+	wire.setRequestHeaders(req, true)
+	res, cancel, err := doStreamRequest(hc, req)
+	if err != nil {
+		pw.Close()
+		return hs, fmt.Errorf("http2 stream request fail at %s, err=[%v]", failedBy(err, nil), err)
+	}
+	if res.StatusCode != http.StatusOK || res.ProtoMajor != 2 {
+		res.Body.Close()
+		pw.Close()
+		cancel()
+		return hs, fmt.Errorf("http2 stream refused by %s, status=[%s] proto=[%s]", failedBy(nil, res), res.Status, res.Proto)
+	}
+	hs = &httpStream{
+		r:    res.Body,
+		w:    pw,
+		wire: wire,
+		closer: func() {
+			pw.Close()
+			res.Body.Close()
+			cancel()
+		},
+	}
+	return hs, err
+}
+
+// The response headers go out at once, so the client starts streaming its body
+func acceptHTTPStream(w http.ResponseWriter, r *http.Request, wire *wireFormat) (hs *httpStream, err error) {
+	rc := http.NewResponseController(w)
+	wire.setResponseHeaders(w.Header())
+	w.WriteHeader(http.StatusOK)
+	if err = rc.Flush(); err != nil {
+		return hs, fmt.Errorf("flush stream response fail, err=[%v]", err)
+	}
+	hs = &httpStream{
+		r:     r.Body,
+		w:     w,
+		flush: rc.Flush,
+		wire:  wire,
+		closer: func() {
+			r.Body.Close()
+		},
+	}
+	return hs, err
+}
+
+// Writes after close are dropped, the response writer must not be used once the handler returns
+func (self *httpStream) writeFrame(frame []byte) (err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.closed {
+		return io.ErrClosedPipe
+	}
+	if _, err = self.w.Write(frame); err == nil && self.flush != nil {
+		err = self.flush()
+	}
+	return err
+}
+
+func (self *httpStream) writeBlock(data []byte) (err error) {
+	return self.writeFrame(self.wire.encodeFrames(data))
+}
+
+func (self *httpStream) ping() (err error) {
+	return self.writeFrame(appendWireFrame(nil, streamFramePing, nil))
+}
+
+func (self *httpStream) readBlock() (data []byte, err error) {
+	for {
+		frame_type, payload, err := readStreamFrame(self.r, self.header[:])
+		if err != nil {
+			return data, err
+		}
+		switch frame_type {
+		case wireFrameData:
+			return payload, err
+		case streamFramePing:
+			if err = self.writeFrame(appendWireFrame(nil, streamFramePong, nil)); err != nil {
+				return data, err
+			}
+		case streamFramePong:
+			return data, err
+		}
+	}
+}
+
+// Padding frames are dropped here, io.EOF only at a frame boundary
+func readStreamFrame(r io.Reader, header []byte) (frame_type byte, payload []byte, err error) {
+	for {
+		if _, err = io.ReadFull(r, header[:wireFrameHeaderSize]); err != nil {
+			return frame_type, payload, err
+		}
+		payload = make([]byte, binary.BigEndian.Uint16(header[1:]))
+		if _, err = io.ReadFull(r, payload); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return frame_type, payload, err
+		}
+		switch frame_type = header[0]; frame_type {
+		case wireFramePadding:
+		case wireFrameData, streamFramePing, streamFramePong:
+			return frame_type, payload, err
+		default:
+			return frame_type, payload, fmt.Errorf("invalid stream frame type, type=%d", frame_type)
+		}
+	}
+}
+
+func (self *httpStream) close() {
+	self.closeOnce.Do(func() {
+		// Closing first wakes up a writer blocked on the pipe
+		self.closer()
+		self.lock.Lock()
+		self.closed = true
+		self.lock.Unlock()
+	})
+}
@@ -3,8 +3,10 @@ package proxy
 import (
 	"common"
 	"fmt"
-	"net"
+	"io"
+	"net/http"
 	"sync"
+	"sync/atomic"
 	log "third/seelog"
 	"time"
 )
@@ -16,90 +18,263 @@ type iTCPClientMgrCallback interface {
 
 type iTCPClient interface {
 	destroy()
-	pushHTTPRequest(seq_number int64, hr *httpRequest) (err error)
+	pushHTTPRequest(seq_number int64, ack int64, hr *httpRequest) (err error)
+	verifyRequest(r *http.Request, payload []byte) (err error)
+	attachStream(split *splitServerStream) (err error)
+	detachStream()
+	serveStream(conn iStreamConn)
+	pushUpload(seq_number int64, data []byte) (err error)
 	keepAlive()
 	String() string
 }
 
 type tcpClient struct {
 	mgrCallback        iTCPClientMgrCallback
+	identity           string
+	macKey             []byte
+	params             *sessionParams
 	lock               sync.Mutex
 	seqNumber          int64
+	window             int64
+	pendingReqs        map[int64]*httpRequest
+	replays            map[int64]*replayEntry
+	stream             bool
+	streamClosed       bool
+	split              *splitServerStream
 	keeyAliveTimestamp int64
-	tcpConn            *net.TCPConn
 	tcpProxy           iTCPProxy
 	reqQueue           chan *httpRequest
 	reqQueueSync       chan *httpRequest
 	resQueue           chan *httpRequest
 }
 
-func newTCPClient(addr string, mgr_callback iTCPClientMgrCallback) (tc iTCPClient) {
-	var err error
-	var tcp_addr *net.TCPAddr
-	var tcp_conn *net.TCPConn
-	var tcp_proxy iTCPProxy
-	var tc_impl *tcpClient
-	if tcp_addr, err = net.ResolveTCPAddr("tcp", addr); err != nil {
-		log.Warnf("ResolveTCPAddr fail, err=[%v] addr=[%s]", err, addr)
-	} else if tcp_conn, err = net.DialTCP("tcp", nil, tcp_addr); err != nil {
-		log.Warnf("DialTCP fail, err=[%v] addr=[%s]", err, addr)
-	} else if tcp_proxy = newTCPProxy(tcp_conn, &dummyFilter{}); tcp_proxy == nil {
-		log.Warnf("newTCPProxy fail, err=[%v] addr=[%s]", err, addr)
-	} else {
-		tc_impl = &tcpClient{
-			mgrCallback:        mgr_callback,
-			seqNumber:          0,
-			keeyAliveTimestamp: common.GetCurrentTime(),
-			tcpConn:            tcp_conn,
-			tcpProxy:           tcp_proxy,
-			reqQueue:           make(chan *httpRequest, DataQueueSize),
-			reqQueueSync:       make(chan *httpRequest, 1),
-			resQueue:           make(chan *httpRequest, DataQueueSize),
-		}
-		go tc_impl.processLoop()
-		go tc_impl.responseLoop()
-		go tc_impl.checkLoop()
-		tc = tc_impl
-	}
-	if tc_impl == nil {
-		if tcp_proxy != nil {
-			tcp_proxy.destroy()
-		}
+// Response of a processed seq, kept until the client acknowledges it, so a
+// retried request gets the same bytes instead of losing them
+type replayEntry struct {
+	once   sync.Once
+	data   []*dataBlock
+	failed bool
+	done   chan bool
+}
+
+// The tcp proxy is either a single destination connection or a multiplexed session
+func newTCPClient(tcp_proxy iTCPProxy, identity string, keys *sessionKeys, params *sessionParams, mgr_callback iTCPClientMgrCallback) (tc iTCPClient) {
+	tc_impl := &tcpClient{
+		mgrCallback:        mgr_callback,
+		identity:           identity,
+		macKey:             keys.macKey,
+		params:             params,
+		seqNumber:          0,
+		window:             pipelineWindow(common.G.Server.PipelineWindow, DefaultServerPipelineWindow),
+		pendingReqs:        make(map[int64]*httpRequest),
+		replays:            make(map[int64]*replayEntry),
+		keeyAliveTimestamp: common.GetCurrentTime(),
+		tcpProxy:           tcp_proxy,
+		reqQueue:           make(chan *httpRequest, DataQueueSize),
+		reqQueueSync:       make(chan *httpRequest, 1),
+		resQueue:           make(chan *httpRequest, DataQueueSize),
 	}
+	go tc_impl.processLoop()
+	go tc_impl.responseLoop()
+	go tc_impl.checkLoop()
+	tc = tc_impl
 	return tc
 }
 
 func (self *tcpClient) destroy() {
 	log.Infof("%s", self.String())
+	self.lock.Lock()
+	for seq, hr := range self.pendingReqs {
+		delete(self.pendingReqs, seq)
+		hr.httpWrapper.setErrorStatus(http.StatusGone)
+		hr.wg.Done()
+	}
+	for _, entry := range self.replays {
+		entry.finish(true)
+	}
+	self.lock.Unlock()
 	self.mgrCallback.onDestroy()
 	close(self.reqQueueSync)
 	self.tcpProxy.destroy()
 }
 
-func (self *tcpClient) pushHTTPRequest(seq_number int64, hr *httpRequest) (err error) {
+// Requests may arrive out of order within the window, they are queued for processing by seq.
+// A seq already processed is a retry, it is answered with the kept response and its body is
+// ignored. ack is the last seq the client has read the response of.
+func (self *tcpClient) pushHTTPRequest(seq_number int64, ack int64, hr *httpRequest) (err error) {
 	self.lock.Lock()
 	defer self.lock.Unlock()
-	if self.seqNumber+1 != seq_number {
-		log.Warnf("invalid seq number, current=%d input=%d %s", self.seqNumber, seq_number, hr.httpWrapper.String())
+	for seq := range self.replays {
+		if seq <= ack {
+			delete(self.replays, seq)
+		}
+	}
+	if self.stream {
+		log.Warnf("session carried by stream, seq=%d %s", seq_number, hr.httpWrapper.String())
+		err = fmt.Errorf("session carried by stream")
+		hr.httpWrapper.setErrorStatus(http.StatusConflict)
+	} else if entry := self.replays[seq_number]; entry != nil && seq_number <= self.seqNumber {
+		log.Infof("retried seq, replay response, seq=%d %s", seq_number, hr.httpWrapper.String())
+		hr.wg.Add(1)
+		self.keepAlive()
+		go self.replay(entry, hr)
+	} else if seq_number <= self.seqNumber || seq_number > self.seqNumber+self.window {
+		log.Warnf("invalid seq number, current=%d input=%d window=%d %s", self.seqNumber, seq_number, self.window, hr.httpWrapper.String())
 		err = fmt.Errorf("invalid seq number, current=%d input=%d", self.seqNumber, seq_number)
-		hr.httpWrapper.setErrorHappened()
+		hr.httpWrapper.setErrorStatus(http.StatusConflict)
 	} else {
+		if old := self.pendingReqs[seq_number]; old != nil {
+			log.Infof("retried seq, replace pending request, seq=%d %s", seq_number, hr.httpWrapper.String())
+			old.httpWrapper.setErrorHappened()
+			old.wg.Done()
+		}
 		hr.wg.Add(1)
-		self.seqNumber += 1
-		self.keeyAliveTimestamp = common.GetCurrentTime()
-		self.reqQueue <- hr
+		self.keepAlive()
+		self.pendingReqs[seq_number] = hr
+		for next := self.pendingReqs[self.seqNumber+1]; next != nil; next = self.pendingReqs[self.seqNumber+1] {
+			delete(self.pendingReqs, self.seqNumber+1)
+			self.seqNumber += 1
+			next.replay = &replayEntry{
+				done: make(chan bool),
+			}
+			self.replays[self.seqNumber] = next.replay
+			delete(self.replays, self.seqNumber-2*DataQueueSize)
+			self.reqQueue <- next
+		}
+	}
+	return err
+}
+
+func (self *tcpClient) replay(entry *replayEntry, hr *httpRequest) {
+	<-entry.done
+	if entry.failed {
+		hr.httpWrapper.setErrorStatus(http.StatusGone)
+	} else {
+		hr.httpWrapper.startResponse()
+		for _, dn := range entry.data {
+			hr.httpWrapper.pushData(dn)
+		}
+		hr.httpWrapper.pushData(nil)
+	}
+	hr.wg.Done()
+}
+
+func (self *replayEntry) finish(failed bool) {
+	self.once.Do(func() {
+		self.failed = failed
+		close(self.done)
+	})
+}
+
+// Data requests must be signed with the mac key negotiated by this session, with
+// the payload they carry, and come with the same client certificate while there is one
+func (self *tcpClient) verifyRequest(r *http.Request, payload []byte) (err error) {
+	if !checkRequestSignature(self.macKey, r.Method, r.URL.Path, r.URL.Query(), payloadHash(self.params.version, payload)) {
+		err = fmt.Errorf("session signature mismatch")
+	} else if cert_name := certIdentity(r); cert_name != "" && cert_name != self.identity {
+		err = fmt.Errorf("client certificate not match session identity, subject=[%s]", cert_name)
 	}
 	return err
 }
 
+// Only a session that has taken no data request may move to a stream transport, and only once
+// split takes the uploads of the split transport, nil for the others
+func (self *tcpClient) attachStream(split *splitServerStream) (err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.stream || self.seqNumber != 0 || len(self.pendingReqs) != 0 {
+		err = fmt.Errorf("session already in use, stream=%t seq=%d", self.stream, self.seqNumber)
+	} else {
+		self.stream = true
+		self.split = split
+	}
+	return err
+}
+
+// Back to long polling after the stream failed before it carried anything, as the client falls back
+func (self *tcpClient) detachStream() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.stream = false
+	self.split = nil
+}
+
+func (self *tcpClient) pushUpload(seq_number int64, data []byte) (err error) {
+	self.lock.Lock()
+	split := self.split
+	self.lock.Unlock()
+	if split == nil {
+		return fmt.Errorf("session not carried by split transport")
+	}
+	return split.push(seq_number, data)
+}
+
+// Returns once the stream closes, the session ends with it. Nil means the stream failed after attach.
+func (self *tcpClient) serveStream(conn iStreamConn) {
+	if conn == nil {
+		self.closeStream()
+		return
+	}
+	log.Infof("session moved to stream transport, %s", self.String())
+	go self.streamRecvLoop(conn)
+	time_out_us := common.G.Server.KeepAliveTimeSec * 1000000
+	for self.tcpProxy.isAlive() && self.isStreamOpen() {
+		var err error
+		if dn := self.tcpProxy.popData(time_out_us); dn != nil {
+			err = conn.writeBlock(dn.data)
+		} else if self.tcpProxy.isAlive() {
+			// The pong of an idle session keeps it alive
+			err = conn.ping()
+		}
+		if err != nil {
+			log.Warnf("stream write fail, err=[%v] %s", err, self.String())
+			break
+		}
+	}
+	conn.close()
+	self.closeStream()
+}
+
+func (self *tcpClient) streamRecvLoop(conn iStreamConn) {
+	for {
+		data, err := conn.readBlock()
+		if err != nil {
+			if err != io.EOF {
+				log.Warnf("stream read fail, err=[%v] %s", err, self.String())
+			} else {
+				log.Infof("stream closed by client, %s", self.String())
+			}
+			break
+		}
+		self.keepAlive()
+		if len(data) > 0 {
+			self.tcpProxy.pushData(&dataBlock{data: data})
+		}
+	}
+	conn.close()
+	self.closeStream()
+}
+
+func (self *tcpClient) closeStream() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.streamClosed = true
+}
+
+func (self *tcpClient) isStreamOpen() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return !self.streamClosed
+}
+
 func (self *tcpClient) keepAlive() {
-	self.keeyAliveTimestamp = common.GetCurrentTime()
+	atomic.StoreInt64(&self.keeyAliveTimestamp, common.GetCurrentTime())
 }
 
 func (self *tcpClient) isAlive(expire_time_sec int64) bool {
 	bret := false
-	if common.GetCurrentTime()-expire_time_sec*1000000 <= self.keeyAliveTimestamp &&
-		self.tcpProxy.isAlive() {
+	if common.GetCurrentTime()-expire_time_sec*1000000 <= atomic.LoadInt64(&self.keeyAliveTimestamp) &&
+		self.tcpProxy.isAlive() && self.isStreamOpen() {
 		bret = true
 	}
 	return bret
@@ -138,7 +313,9 @@ func (self *tcpClient) processLoop() {
 			self.resQueue <- req
 		} else {
 			log.Infof("connection not alive, return error, %s", self.String())
-			req.httpWrapper.setErrorHappened()
+			req.httpWrapper.setErrorStatus(http.StatusGone)
+			req.replay.finish(true)
+			req.wg.Done()
 		}
 	}
 	self.resQueue <- nil
@@ -159,8 +336,10 @@ func (self *tcpClient) responseLoop() {
 			if dn == nil {
 				break
 			}
+			req.replay.data = append(req.replay.data, dn)
 			time_out_us = 0
 		}
+		req.replay.finish(false)
 		req.wg.Done()
 	}
 }
@@ -177,6 +356,8 @@ func (self *tcpClient) checkLoop() {
 }
 
 func (self *tcpClient) String() string {
-	return fmt.Sprintf("this=%p seq=%d aliveTimestamp=%d %s reqQueueLen=%d resQueueLen=%d",
-		self, self.seqNumber, self.keeyAliveTimestamp, self.tcpProxy.String(), len(self.reqQueue), len(self.resQueue))
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return fmt.Sprintf("this=%p connKey=[%s] identity=[%s] %s seq=%d window=%d pending=%d replays=%d stream=%t aliveTimestamp=%d %s reqQueueLen=%d resQueueLen=%d",
+		self, self.mgrCallback.getConnKey(), self.identity, self.params.String(), self.seqNumber, self.window, len(self.pendingReqs), len(self.replays), self.stream, atomic.LoadInt64(&self.keeyAliveTimestamp), self.tcpProxy.String(), len(self.reqQueue), len(self.resQueue))
 }
@@ -0,0 +1,24 @@
+package proxy
+
+import "testing"
+
+func TestTCPClientDetachStream(t *testing.T) {
+	tc := &tcpClient{}
+	split := newSplitServerStream()
+	if err := tc.attachStream(split); err != nil {
+		t.Fatalf("attach fail, err=[%v]", err)
+	}
+	if err := tc.attachStream(nil); err == nil {
+		t.Fatalf("second stream attached")
+	}
+	tc.detachStream()
+	if tc.stream || tc.split != nil {
+		t.Fatalf("stream=%t split=%v after detach", tc.stream, tc.split)
+	}
+	if err := tc.pushUpload(1, nil); err == nil {
+		t.Fatalf("upload taken after detach")
+	}
+	if err := tc.attachStream(nil); err != nil {
+		t.Fatalf("attach after detach fail, err=[%v]", err)
+	}
+}
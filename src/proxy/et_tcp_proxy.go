@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync/atomic"
 	log "third/seelog"
 	"time"
 )
@@ -24,30 +25,37 @@ type iFilter interface {
 	onDataRecv(dn *dataBlock) (*dataBlock, error)
 	onDataSend(dn *dataBlock) (*dataBlock, error)
 	dataBlockSize() int64
+	String() string
 }
 
 type tcpProxy struct {
-	conn      *net.TCPConn
+	conn      net.Conn
 	dnFilter  iFilter
 	sendQ     chan *dataBlock
 	sendQsync chan *dataBlock
 	recvQ     chan *dataBlock
-	connAlive bool
+	connAlive int32
 }
 
 type dummyFilter struct{}
 
-func newTCPProxy(conn *net.TCPConn, dn_filter iFilter) (tp iTCPProxy) {
+// conn is a tcp connection of a listener, or the end of a pipe for requests proxied by the client
+func newTCPProxy(conn net.Conn, dn_filter iFilter) (tp iTCPProxy) {
 	tp_impl := &tcpProxy{
 		conn:      conn,
 		dnFilter:  dn_filter,
 		sendQ:     make(chan *dataBlock, DataQueueSize),
 		sendQsync: make(chan *dataBlock, 1),
 		recvQ:     make(chan *dataBlock, DataQueueSize),
-		connAlive: true,
+		connAlive: 1,
+	}
+	if tcp_conn, ok := conn.(interface {
+		SetReadBuffer(bytes int) error
+		SetWriteBuffer(bytes int) error
+	}); ok {
+		tcp_conn.SetReadBuffer(int(dn_filter.dataBlockSize()))
+		tcp_conn.SetWriteBuffer(int(dn_filter.dataBlockSize()))
 	}
-	conn.SetReadBuffer(int(dn_filter.dataBlockSize()))
-	conn.SetWriteBuffer(int(dn_filter.dataBlockSize()))
 	go tp_impl.sendLoop()
 	go tp_impl.recvLoop()
 	tp = tp_impl
@@ -56,14 +64,14 @@ func newTCPProxy(conn *net.TCPConn, dn_filter iFilter) (tp iTCPProxy) {
 
 func (self *tcpProxy) destroy() {
 	log.Infof("%s", self.String())
-	self.connAlive = false
+	atomic.StoreInt32(&self.connAlive, 0)
 	self.conn.Close()
 	close(self.sendQsync)
 	self.recvQ <- nil
 }
 
 func (self *tcpProxy) isAlive() bool {
-	return (self.connAlive || 0 != len(self.recvQ))
+	return (atomic.LoadInt32(&self.connAlive) != 0 || 0 != len(self.recvQ))
 }
 
 func (self *tcpProxy) popFromSendQ() (dn *dataBlock) {
@@ -84,10 +92,10 @@ func (self *tcpProxy) sendLoop() {
 		if write_ret != len(dn.data) ||
 			err != nil {
 			log.Warnf("write fail, write_ret=%d err=[%v]", write_ret, err)
-			self.connAlive = false
+			atomic.StoreInt32(&self.connAlive, 0)
 			break
 		} else {
-			log.Debugf("send data succ, len=%d %s", write_ret, self.String())
+			log.Debugf("send data succ, len=%d this=%p", write_ret, self)
 		}
 	}
 }
@@ -114,10 +122,10 @@ func (self *tcpProxy) recvLoop() {
 			} else {
 				log.Infof("connection close, read_ret=%d err=[%v]", read_ret, err)
 			}
-			self.connAlive = false
+			atomic.StoreInt32(&self.connAlive, 0)
 			break
 		} else {
-			log.Debugf("recv data succ, len=%d %s", read_ret, self.String())
+			log.Debugf("recv data succ, len=%d this=%p", read_ret, self)
 		}
 	}
 }
@@ -128,7 +136,8 @@ func (self *tcpProxy) pushData(dn *dataBlock) {
 		self.sendQ <- filtered_dn
 	}
 	if tmp_err != nil {
-		self.connAlive = false
+		log.Warnf("filter data fail, err=[%v] %s", tmp_err, self.String())
+		atomic.StoreInt32(&self.connAlive, 0)
 	}
 }
 
@@ -152,8 +161,8 @@ func (self *tcpProxy) popData(time_wait_us int64) (dn *dataBlock) {
 }
 
 func (self *tcpProxy) String() string {
-	return fmt.Sprintf("this=%p remote=[%s] local=[%s] alive=%t sendQLen=%d recvQLen=%d",
-		self, self.conn.RemoteAddr().String(), self.conn.LocalAddr().String(), self.connAlive, len(self.sendQ), len(self.recvQ))
+	return fmt.Sprintf("this=%p remote=[%s] local=[%s] alive=%t sendQLen=%d recvQLen=%d %s",
+		self, self.conn.RemoteAddr().String(), self.conn.LocalAddr().String(), atomic.LoadInt32(&self.connAlive) != 0, len(self.sendQ), len(self.recvQ), self.dnFilter.String())
 }
 
 func (self *dummyFilter) onDataRecv(dn *dataBlock) (*dataBlock, error) {
@@ -167,3 +176,7 @@ func (self *dummyFilter) onDataSend(dn *dataBlock) (*dataBlock, error) {
 func (self *dummyFilter) dataBlockSize() int64 {
 	return DataBlockSize
 }
+
+func (self *dummyFilter) String() string {
+	return "filter=[none]"
+}
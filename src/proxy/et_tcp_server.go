@@ -1,65 +1,259 @@
 package proxy
 
 import (
+	"common"
 	"fmt"
 	"net"
+	"sync"
 	log "third/seelog"
 	"time"
 )
 
+// The client listener forwards every connection to the -dest of the command line,
+// or takes the destination from a socks5 or http proxy request of the connection.
+// In reverse mode the tunnel server listens instead and the client dials -dest.
+const (
+	ListenModeForward = "forward"
+	ListenModeSocks5  = "socks5"
+	ListenModeHTTP    = "http"
+	ListenModeReverse = "reverse"
+)
+
 type iClientServer interface {
 	Start()
+	Reload() error
 }
 
+// One listener of the client, the one of the client section or a forward of client.Forwards
 type clientServer struct {
+	lock          sync.RWMutex
+	name          string
+	index         int
 	bindAddress   string
-	proxyAddress  string
 	remoteAddress string
+	listenMode    string
+	ctx           *clientContext
+	muxSession    *tcpServer
 	l             *net.TCPListener
+	// status, connections are counted until closed
+	state     string
+	bound     string
+	lastError string
+	accepted  int64
+	active    int64
+	failed    int64
 }
 
 type tcpServer struct {
 	httpClient iHTTPClient
 	tcpProxy   iTCPProxy
+	mux        *muxProxy
+}
+
+// index is the forward of client.Forwards, -1 for the listener of the client section
+func newClientServer(name string, index int, dest string) (cs *clientServer, err error) {
+	var ctx *clientContext
+	c := common.Config().Client.ListenerConfig(index)
+	listen_mode := common.ValueOrDefault(c.ListenMode, ListenModeForward)
+	if err = checkListenMode(listen_mode); err != nil {
+		err = fmt.Errorf("checkListenMode fail, err=[%v]", err)
+	} else if (listen_mode == ListenModeForward || listen_mode == ListenModeReverse) && dest == "" {
+		err = fmt.Errorf("no destination to forward to")
+	} else if ctx, err = newClientContext(c); err != nil {
+		err = fmt.Errorf("newClientContext fail, err=[%v]", err)
+	} else {
+		cs = &clientServer{
+			name:          name,
+			index:         index,
+			bindAddress:   c.BindAddress,
+			remoteAddress: dest,
+			listenMode:    listen_mode,
+			ctx:           ctx,
+			state:         ListenerStarting,
+		}
+	}
+	return cs, err
 }
 
-func NewClientServer(bindAddress string, proxyAddress string, remoteAddress string) (cs iClientServer) {
-	cs_impl := &clientServer{
-		bindAddress:   bindAddress,
-		proxyAddress:  proxyAddress,
-		remoteAddress: remoteAddress,
+func checkListenMode(listen_mode string) (err error) {
+	switch listen_mode {
+	case ListenModeForward, ListenModeSocks5, ListenModeHTTP, ListenModeReverse:
+	default:
+		err = fmt.Errorf("invalid listen mode, mode=[%s]", listen_mode)
 	}
-	cs = cs_impl
-	return cs
+	return err
 }
 
+// Returns once the listener fails, the other listeners of the client keep running
 func (self *clientServer) Start() {
-	tcp_addr, _ := net.ResolveTCPAddr("tcp", self.bindAddress)
-	listener, _ := net.ListenTCP("tcp", tcp_addr)
-	for {
-		tcp_conn, _ := listener.AcceptTCP()
-		if tcp_conn != nil {
-			ts := newTCPServer(self.proxyAddress, self.remoteAddress, tcp_conn)
-			if ts != nil {
-				log.Infof("new tcp server, %s", ts.String())
+	var listener *net.TCPListener
+	if self.listenMode == ListenModeReverse {
+		self.serveReverse()
+		return
+	}
+	tcp_addr, err := net.ResolveTCPAddr("tcp", self.bindAddress)
+	if err == nil {
+		listener, err = net.ListenTCP("tcp", tcp_addr)
+	}
+	if err != nil {
+		self.setState(ListenerFailed, err)
+		log.Errorf("listen fail, err=[%v] %s", err, self.String())
+		return
+	}
+	self.setState(ListenerListening, nil)
+	self.setBound(listener.Addr().String())
+	log.Infof("listen succ, %s", self.String())
+	tracked := &trackedListener{TCPListener: listener, clientServer: self}
+	if self.listenMode == ListenModeHTTP {
+		err = self.serveHTTPProxy(tracked)
+	} else {
+		for {
+			conn, accept_err := tracked.Accept()
+			if err = accept_err; err != nil {
+				break
+			} else if self.listenMode == ListenModeSocks5 {
+				go self.serveSocks5(conn)
 			} else {
-				tcp_conn.Close()
+				self.openTunnel(conn, self.remoteAddress, nil)
+			}
+		}
+	}
+	self.setState(ListenerFailed, err)
+	log.Errorf("accept fail, err=[%v] %s", err, self.String())
+}
+
+// Carry conn to dest by a stream of the mux session, or by a session of its own. opened is
+// told whether the tunnel server reached dest before any data is relayed, unless it is nil.
+func (self *clientServer) openTunnel(conn net.Conn, dest string, opened func(err error) error) {
+	ctx := self.getContext()
+	if opened != nil {
+		opened = self.countFailure(opened)
+	}
+	if ctx.config.Multiplex {
+		if err := self.openMuxStream(conn, dest, opened); err != nil {
+			log.Warnf("openMuxStream fail, err=[%v] dest=[%s]", err, dest)
+			if opened != nil {
+				opened(err)
+			} else {
+				self.tunnelFailed(err)
+			}
+			conn.Close()
+		}
+	} else if ts, err := newTCPServer(ctx, dest, conn, opened); err == nil {
+		log.Infof("new tcp server, %s", ts.String())
+	} else {
+		if opened == nil {
+			self.tunnelFailed(err)
+		}
+		conn.Close()
+	}
+}
+
+// New sessions use the reloaded keys and credentials, running sessions keep the old context
+func (self *clientServer) Reload() (err error) {
+	ctx, err := newClientContext(common.Config().Client.ListenerConfig(self.index))
+	if err != nil {
+		return fmt.Errorf("newClientContext fail, err=[%v]", err)
+	}
+	self.lock.Lock()
+	old_ctx := self.ctx
+	self.ctx = ctx
+	self.lock.Unlock()
+	old_ctx.hc.CloseIdleConnections()
+	return err
+}
+
+func (self *clientServer) getContext() *clientContext {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.ctx
+}
+
+// Streams share one session until it dies or stays idle, then the next stream connects a new one.
+// The session is connected without the lock held, of two sessions connected at once the one
+// published first is shared, the other one carries its stream until it goes idle.
+func (self *clientServer) openMuxStream(conn net.Conn, dest string, opened func(err error) error) (err error) {
+	for retry := 0; retry < 2; retry++ {
+		self.lock.RLock()
+		session, ctx := self.muxSession, self.ctx
+		self.lock.RUnlock()
+		if session == nil || !session.tcpProxy.isAlive() {
+			var created *tcpServer
+			if created, err = newMuxTCPServer(ctx, "", nil); err != nil {
+				return fmt.Errorf("connect mux session fail, err=[%v]", err)
 			}
-		} else {
+			self.lock.Lock()
+			if self.muxSession == session {
+				self.muxSession = created
+			}
+			self.lock.Unlock()
+			session = created
+			log.Infof("new mux session, %s", session.String())
+		}
+		if err = session.mux.openStream(conn, dest, opened); err == nil {
 			break
 		}
 	}
+	return err
 }
 
-func newTCPServer(host string, dest string, conn *net.TCPConn) (ts *tcpServer) {
-	ts = &tcpServer{
-		httpClient: newHTTPClient(host, dest),
-		tcpProxy:   newTCPProxy(conn, &dummyFilter{}),
+// opened is told the result of the connect before the connection takes any data, unless it is nil
+func newTCPServer(ctx *clientContext, dest string, conn net.Conn, opened func(err error) error) (ts *tcpServer, err error) {
+	var dn_filter iFilter
+	var http_client iHTTPClient
+	if http_client, err = newHTTPClient(ctx, dest, false); err != nil {
+		log.Warnf("newHTTPClient fail, err=[%v] host=[%s] dest=[%s]", err, ctx.host, dest)
+	} else if dn_filter = newSessionFilter(http_client.sessionKeys(), http_client.sessionParams()); dn_filter == nil {
+		log.Warnf("newSessionFilter fail, dest=[%s]", dest)
+		err = fmt.Errorf("newSessionFilter fail")
+		http_client.destroy()
+	}
+	if opened != nil {
+		if open_err := opened(err); err == nil && open_err != nil {
+			err = open_err
+			http_client.destroy()
+		}
+	}
+	if err == nil {
+		ts = &tcpServer{
+			httpClient: http_client,
+			tcpProxy:   newTCPProxy(conn, dn_filter),
+		}
+		go ts.sendLoop()
+		go ts.recvLoop()
+		go ts.checkLoop()
+	}
+	return ts, err
+}
+
+// The session has no connection of its own, streams are added by openStream of mux. A reverse
+// session asks the tunnel server to listen on reverse_bind, handler opens the streams pushed
+// by the server and the session is never idle.
+func newMuxTCPServer(ctx *clientContext, reverse_bind string, handler iMuxHandler) (ts *tcpServer, err error) {
+	var dn_filter iFilter
+	var http_client iHTTPClient
+	idle_timeout_sec := MuxIdleTimeoutSec
+	if reverse_bind != "" {
+		idle_timeout_sec = 0
+	}
+	if http_client, err = newHTTPClient(ctx, reverse_bind, true); err != nil {
+		log.Warnf("newHTTPClient fail, err=[%v] host=[%s] mux=true reverse=[%s]", err, ctx.host, reverse_bind)
+	} else if dn_filter = newSessionFilter(http_client.sessionKeys(), http_client.sessionParams()); dn_filter == nil {
+		log.Warnf("newSessionFilter fail, mux=true")
+		err = fmt.Errorf("newSessionFilter fail")
+		http_client.destroy()
+	} else {
+		mux := newMuxProxy(dn_filter, handler, 1, idle_timeout_sec, http_client.sessionParams().version)
+		ts = &tcpServer{
+			httpClient: http_client,
+			tcpProxy:   mux,
+			mux:        mux,
+		}
+		go ts.sendLoop()
+		go ts.recvLoop()
+		go ts.checkLoop()
 	}
-	go ts.sendLoop()
-	go ts.recvLoop()
-	go ts.checkLoop()
-	return ts
+	return ts, err
 }
 
 func (self *tcpServer) destroy() {
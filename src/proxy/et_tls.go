@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"bytes"
+	"common"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	log "third/seelog"
+)
+
+// Return nil config while tls is not configured, the server will serve plain http
+func newServerTLSConfig() (config *tls.Config, err error) {
+	c := &common.Config().Server
+	cert_file, key_file := c.TLSCertFilePath, c.TLSKeyFilePath
+	if cert_file == "" && key_file == "" {
+		return config, err
+	}
+	if cert_file == "" || key_file == "" {
+		err = fmt.Errorf("TLSCertFilePath and TLSKeyFilePath must be set together")
+	} else if cert, tmp_err := tls.LoadX509KeyPair(cert_file, key_file); tmp_err != nil {
+		err = fmt.Errorf("load x509 key pair fail, err=[%v] cert=[%s] key=[%s]", tmp_err, cert_file, key_file)
+	} else {
+		log.Infof("load server certificate succ, fingerprint=[%s] cert=[%s]", certFingerprint(cert.Certificate[0]), cert_file)
+		config = &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{cert},
+		}
+		if ca_file := c.TLSClientCAFilePath; ca_file != "" {
+			if config.ClientCAs, err = loadCertPool(ca_file); err != nil {
+				config = nil
+			} else {
+				log.Infof("client certificate required, ca=[%s]", ca_file)
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+		}
+	}
+	return config, err
+}
+
+func loadCertPool(ca_file string) (pool *x509.CertPool, err error) {
+	if pem, tmp_err := os.ReadFile(ca_file); tmp_err != nil {
+		err = fmt.Errorf("read ca file fail, err=[%v] path=[%s]", tmp_err, ca_file)
+	} else {
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			err = fmt.Errorf("no certificate found in ca file, path=[%s]", ca_file)
+			pool = nil
+		}
+	}
+	return pool, err
+}
+
+func newClientTLSConfig(c *common.ClientConfig) (config *tls.Config, err error) {
+	var pin []byte
+	config = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: c.TLSServerName,
+	}
+	if ca_file := c.TLSCAFilePath; ca_file != "" {
+		config.RootCAs, err = loadCertPool(ca_file)
+	}
+	cert_file := c.TLSCertFilePath
+	key_file := c.TLSKeyFilePath
+	if err == nil && (cert_file != "" || key_file != "") {
+		if cert, tmp_err := tls.LoadX509KeyPair(cert_file, key_file); tmp_err != nil {
+			err = fmt.Errorf("load client certificate fail, err=[%v] cert=[%s] key=[%s]", tmp_err, cert_file, key_file)
+		} else {
+			log.Infof("load client certificate succ, fingerprint=[%s] cert=[%s]", certFingerprint(cert.Certificate[0]), cert_file)
+			config.Certificates = []tls.Certificate{cert}
+		}
+	}
+	if err == nil && c.TLSPinSHA256 != "" {
+		if pin, err = parseFingerprint(c.TLSPinSHA256); err == nil {
+			// A pinned certificate may be self signed, only verify the chain while a ca is given
+			config.InsecureSkipVerify = (config.RootCAs == nil)
+			config.VerifyConnection = func(cs tls.ConnectionState) error {
+				return verifyPinnedCertificate(cs, pin)
+			}
+		}
+	}
+	if err != nil {
+		config = nil
+	}
+	return config, err
+}
+
+func verifyPinnedCertificate(cs tls.ConnectionState, pin []byte) (err error) {
+	if len(cs.PeerCertificates) == 0 {
+		err = fmt.Errorf("no peer certificate")
+	} else if sum := sha256.Sum256(cs.PeerCertificates[0].Raw); !bytes.Equal(sum[:], pin) {
+		err = fmt.Errorf("peer certificate fingerprint mismatch, fingerprint=[%s]", certFingerprint(cs.PeerCertificates[0].Raw))
+	}
+	return err
+}
+
+// Accept the openssl x509 -fingerprint -sha256 output, colons are optional
+func parseFingerprint(s string) (pin []byte, err error) {
+	s = strings.TrimPrefix(strings.ToLower(s), "sha256:")
+	s = strings.Replace(s, ":", "", -1)
+	if pin, err = hex.DecodeString(s); err != nil {
+		err = fmt.Errorf("invalid fingerprint, err=[%v]", err)
+	} else if len(pin) != sha256.Size {
+		err = fmt.Errorf("invalid fingerprint length, len=%d", len(pin))
+	}
+	return pin, err
+}
+
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
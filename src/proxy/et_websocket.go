@@ -0,0 +1,278 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal websocket (rfc 6455) carrying the sealed blocks of a session, one
+// binary message per block in both directions. Only what the tunnel needs is
+// supported, there are no extensions and no subprotocols.
+const (
+	wsAcceptGUID           = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsOpContinuation byte  = 0x0
+	wsOpText         byte  = 0x1
+	wsOpBinary       byte  = 0x2
+	wsOpClose        byte  = 0x8
+	wsOpPing         byte  = 0x9
+	wsOpPong         byte  = 0xa
+	wsMaxMessageSize int64 = 2 * DataBlockSize
+)
+
+type wsConn struct {
+	conn      io.ReadWriteCloser
+	r         *bufio.Reader
+	lock      sync.Mutex
+	closeOnce sync.Once
+	cancel    context.CancelFunc
+	// frames sent by the client must be masked
+	mask bool
+}
+
+func wsAcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + wsAcceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func headerHasToken(h http.Header, name string, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isWebSocketUpgrade(r *http.Request) bool {
+	return headerHasToken(r.Header, "Connection", "upgrade") && headerHasToken(r.Header, "Upgrade", "websocket")
+}
+
+func checkWebSocketHandshake(r *http.Request) (err error) {
+	if r.Method != http.MethodGet {
+		err = fmt.Errorf("invalid websocket method, method=[%s]", r.Method)
+	} else if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		err = fmt.Errorf("unsupported websocket version, version=[%s]", r.Header.Get("Sec-WebSocket-Version"))
+	} else if r.Header.Get("Sec-WebSocket-Key") == "" {
+		err = fmt.Errorf("no websocket key")
+	}
+	return err
+}
+
+// Take over the connection of a request passed checkWebSocketHandshake and answer the upgrade
+func acceptWebSocket(w http.ResponseWriter, r *http.Request) (ws *wsConn, err error) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return ws, fmt.Errorf("connection can not be hijacked")
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return ws, fmt.Errorf("hijack connection fail, err=[%v]", err)
+	}
+	conn.SetDeadline(time.Time{})
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	brw.WriteString("Sec-WebSocket-Accept: " + wsAcceptKey(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n")
+	if err = brw.Flush(); err != nil {
+		conn.Close()
+		return ws, fmt.Errorf("write websocket handshake fail, err=[%v]", err)
+	}
+	ws = &wsConn{
+		conn: conn,
+		r:    brw.Reader,
+	}
+	return ws, err
+}
+
+// Upgrade a request to u, an intermediary that blocks upgrades either answers
+// something else or never answers, both end in an error within the timeout
+func dialWebSocket(hc *http.Client, u string, wire *wireFormat) (ws *wsConn, err error) {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req, _ := http.NewRequest(http.MethodGet, u, nil)
+	wire.setRequestHeaders(req, false)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	res, cancel, err := doStreamRequest(hc, req)
+	if err != nil {
+		return ws, fmt.Errorf("websocket handshake fail at %s, err=[%v]", failedBy(err, nil), err)
+	}
+	rwc, ok := res.Body.(io.ReadWriteCloser)
+	if res.StatusCode != http.StatusSwitchingProtocols || !ok {
+		err = fmt.Errorf("websocket upgrade refused by %s, status=[%s]", failedBy(nil, res), res.Status)
+	} else if res.Header.Get("Sec-WebSocket-Accept") != wsAcceptKey(key) {
+		err = fmt.Errorf("websocket accept key mismatch")
+	}
+	if err != nil {
+		res.Body.Close()
+		cancel()
+		return ws, err
+	}
+	ws = &wsConn{
+		conn:   rwc,
+		r:      bufio.NewReader(rwc),
+		cancel: cancel,
+		mask:   true,
+	}
+	return ws, err
+}
+
+func (self *wsConn) writeMessage(opcode byte, payload []byte) (err error) {
+	frame := make([]byte, 2, 14+len(payload))
+	frame[0] = 0x80 | opcode
+	switch n := len(payload); {
+	case n < 126:
+		frame[1] = byte(n)
+	case n <= 0xffff:
+		frame[1] = 126
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame[1] = 127
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	if self.mask {
+		var key [4]byte
+		rand.Read(key[:])
+		frame[1] |= 0x80
+		frame = append(frame, key[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range payload {
+			frame[start+i] ^= key[i&3]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	_, err = self.conn.Write(frame)
+	return err
+}
+
+func (self *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(self.r, header[:]); err != nil {
+		return fin, opcode, payload, err
+	}
+	fin, opcode = header[0]&0x80 != 0, header[0]&0x0f
+	size := int64(header[1] & 0x7f)
+	switch size {
+	case 126:
+		var ext [2]byte
+		_, err = io.ReadFull(self.r, ext[:])
+		size = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, err = io.ReadFull(self.r, ext[:])
+		size = int64(binary.BigEndian.Uint64(ext[:]))
+	}
+	var key [4]byte
+	if err == nil && header[1]&0x80 != 0 {
+		_, err = io.ReadFull(self.r, key[:])
+	}
+	if err != nil {
+		return fin, opcode, payload, err
+	}
+	if size < 0 || size > wsMaxMessageSize {
+		return fin, opcode, payload, fmt.Errorf("websocket frame too large, size=%d", size)
+	}
+	payload = make([]byte, size)
+	if _, err = io.ReadFull(self.r, payload); err != nil {
+		return fin, opcode, payload, err
+	}
+	if header[1]&0x80 != 0 {
+		for i := range payload {
+			payload[i] ^= key[i&3]
+		}
+	}
+	return fin, opcode, payload, err
+}
+
+// Returns binary messages and pongs, pings are answered here. io.EOF once the peer closes.
+func (self *wsConn) readMessage() (opcode byte, data []byte, err error) {
+	in_message := false
+	for {
+		fin, frame_opcode, payload, err := self.readFrame()
+		if err != nil {
+			return opcode, data, err
+		}
+		switch frame_opcode {
+		case wsOpPing:
+			if err = self.writeMessage(wsOpPong, payload); err != nil {
+				return opcode, data, err
+			}
+			continue
+		case wsOpPong:
+			if !in_message {
+				return wsOpPong, payload, err
+			}
+			continue
+		case wsOpClose:
+			self.close()
+			return opcode, data, io.EOF
+		case wsOpBinary, wsOpText:
+			if in_message {
+				return opcode, data, fmt.Errorf("websocket message interrupted")
+			}
+			opcode, data, in_message = frame_opcode, payload, true
+		case wsOpContinuation:
+			if !in_message {
+				return opcode, data, fmt.Errorf("websocket continuation without message")
+			}
+			data = append(data, payload...)
+		default:
+			return opcode, data, fmt.Errorf("invalid websocket opcode, opcode=%d", frame_opcode)
+		}
+		if int64(len(data)) > wsMaxMessageSize {
+			return opcode, data, fmt.Errorf("websocket message too large, size=%d", len(data))
+		}
+		if fin {
+			return opcode, data, err
+		}
+	}
+}
+
+func (self *wsConn) readBlock() (data []byte, err error) {
+	opcode, data, err := self.readMessage()
+	for err == nil && opcode == wsOpText {
+		opcode, data, err = self.readMessage()
+	}
+	if opcode == wsOpPong {
+		data = nil
+	}
+	return data, err
+}
+
+func (self *wsConn) writeBlock(data []byte) (err error) {
+	return self.writeMessage(wsOpBinary, data)
+}
+
+func (self *wsConn) ping() (err error) {
+	return self.writeMessage(wsOpPing, nil)
+}
+
+// Send a close frame and close the connection, safe to call more than once
+func (self *wsConn) close() {
+	self.closeOnce.Do(func() {
+		self.writeMessage(wsOpClose, []byte{0x03, 0xe8})
+		self.conn.Close()
+		if self.cancel != nil {
+			self.cancel()
+		}
+	})
+}
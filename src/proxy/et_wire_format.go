@@ -0,0 +1,288 @@
+package proxy
+
+import (
+	"common"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The wire format maps the paths and query keys used inside the tunnel to the
+// names seen on the network. Requests are signed over the internal form, the
+// client renames after signing and the server renames back before verifying.
+// While obfuscation is enabled every body is cut into frames:
+//
+//	| type (1 byte) | length (2 bytes) | payload |
+//
+// and ends with a padding frame of random size, so body sizes no longer
+// mirror the tcp payload.
+const (
+	wireFrameHeaderSize int   = 3
+	wireFrameData       byte  = 0
+	wireFramePadding    byte  = 1
+	wireFrameMaxPayload int   = math.MaxUint16
+	DefaultPaddingMax   int64 = 512
+
+	DefaultObfsConnectPath         = "/api/v1/session"
+	DefaultObfsDataPath            = "/api/v1/sync"
+	DefaultObfsUserAgent           = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36"
+	DefaultObfsRequestContentType  = "application/octet-stream"
+	DefaultObfsResponseContentType = "application/octet-stream"
+	DefaultPayloadHeader           = "X-Client-Data"
+)
+
+type wireFormat struct {
+	enable              bool
+	paths               map[string]string
+	params              map[string]string
+	localPaths          map[string]string
+	localParams         map[string]string
+	paddingMax          int64
+	headers             http.Header
+	requestContentType  string
+	responseContentType string
+	payloadHeader       string
+}
+
+type wireBodyReader struct {
+	r      io.Reader
+	remain int
+	header [wireFrameHeaderSize]byte
+}
+
+func newWireFormat() (wf *wireFormat, err error) {
+	c := common.G.Basic.Obfuscation
+	wf_impl := &wireFormat{
+		enable:      c.Enable,
+		paths:       make(map[string]string),
+		params:      make(map[string]string),
+		localPaths:  make(map[string]string),
+		localParams: make(map[string]string),
+		headers:     make(http.Header),
+	}
+	wf_impl.payloadHeader = http.CanonicalHeaderKey(common.ValueOrDefault(c.PayloadHeader, DefaultPayloadHeader))
+	if !c.Enable {
+		return wf_impl, err
+	}
+
+	paths := map[string]string{
+		QP_CONNECT: common.ValueOrDefault(c.ConnectPath, DefaultObfsConnectPath),
+		QP_DATA:    common.ValueOrDefault(c.DataPath, DefaultObfsDataPath),
+	}
+	params := map[string]string{
+		QK_CONN_KEY:  common.ValueOrDefault(c.ParamSession, "sid"),
+		QK_ADDR:      common.ValueOrDefault(c.ParamAddr, "ref"),
+		QK_SEQ:       common.ValueOrDefault(c.ParamSeq, "n"),
+		QK_HANDSHAKE: common.ValueOrDefault(c.ParamHandshake, "state"),
+		QK_AUTH_ID:   common.ValueOrDefault(c.ParamAuthId, "client_id"),
+		QK_TIMESTAMP: common.ValueOrDefault(c.ParamTimestamp, "ts"),
+		QK_SIGNATURE: common.ValueOrDefault(c.ParamSignature, "sig"),
+		QK_MUX:       common.ValueOrDefault(c.ParamMux, "v"),
+		QK_ACK:       common.ValueOrDefault(c.ParamAck, "since"),
+		QK_TRANSPORT: common.ValueOrDefault(c.ParamTransport, "mode"),
+		QK_PAYLOAD:   common.ValueOrDefault(c.ParamPayload, "data"),
+		QK_COMPRESS:  common.ValueOrDefault(c.ParamCompress, "enc"),
+		QK_FILTERS:   common.ValueOrDefault(c.ParamFilters, "opts"),
+		QK_VERSION:   common.ValueOrDefault(c.ParamVersion, "ver"),
+		QK_MAX_BLOCK: common.ValueOrDefault(c.ParamBlockSize, "size"),
+		QK_REVERSE:   common.ValueOrDefault(c.ParamReverse, "callback"),
+	}
+	for local, wire := range paths {
+		wire = "/" + strings.Trim(wire, "/")
+		if _, exist := wf_impl.localPaths[wire]; exist || wire == "/" {
+			return wf, fmt.Errorf("invalid obfuscation path, path=[%s]", wire)
+		}
+		wf_impl.paths[local] = wire
+		wf_impl.localPaths[wire] = local
+	}
+	for local, wire := range params {
+		if _, exist := wf_impl.localParams[wire]; exist {
+			return wf, fmt.Errorf("duplicate obfuscation param name, name=[%s]", wire)
+		}
+		wf_impl.params[local] = wire
+		wf_impl.localParams[wire] = local
+	}
+	for _, h := range c.Headers {
+		i := strings.Index(h, ":")
+		if i <= 0 {
+			return wf, fmt.Errorf("invalid obfuscation header, header=[%s]", h)
+		}
+		wf_impl.headers.Add(strings.TrimSpace(h[:i]), strings.TrimSpace(h[i+1:]))
+	}
+	if wf_impl.headers.Get("User-Agent") == "" {
+		wf_impl.headers.Set("User-Agent", common.ValueOrDefault(c.UserAgent, DefaultObfsUserAgent))
+	}
+	if wf_impl.headers.Get("Accept") == "" {
+		wf_impl.headers.Set("Accept", "*/*")
+	}
+	if wf_impl.headers.Get("Accept-Language") == "" {
+		wf_impl.headers.Set("Accept-Language", "en-US,en;q=0.9")
+	}
+	if wf_impl.headers.Get("Cache-Control") == "" {
+		wf_impl.headers.Set("Cache-Control", "no-cache")
+	}
+	wf_impl.requestContentType = common.ValueOrDefault(c.RequestContentType, DefaultObfsRequestContentType)
+	wf_impl.responseContentType = common.ValueOrDefault(c.ResponseContentType, DefaultObfsResponseContentType)
+	wf_impl.paddingMax = c.PaddingMaxSize
+	if wf_impl.paddingMax <= 0 || wf_impl.paddingMax > int64(wireFrameMaxPayload) {
+		wf_impl.paddingMax = DefaultPaddingMax
+	}
+	wf = wf_impl
+	return wf, err
+}
+
+// Rename path and query keys to the wire names, called after the request is signed
+func (self *wireFormat) encodeURL(u *url.URL) {
+	if !self.enable {
+		return
+	}
+	u.Path = self.paths[strings.TrimPrefix(u.Path, "/")]
+	q := url.Values{}
+	for k, v := range u.Query() {
+		if wire, exist := self.params[k]; exist {
+			k = wire
+		}
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+}
+
+// Rename path and query keys back to the internal names, false while the path is unknown
+func (self *wireFormat) decodeURL(u *url.URL) bool {
+	if !self.enable {
+		return true
+	}
+	local, exist := self.localPaths["/"+strings.Trim(u.Path, "/")]
+	if !exist {
+		return false
+	}
+	q := url.Values{}
+	for k, v := range u.Query() {
+		if local, exist := self.localParams[k]; exist {
+			k = local
+		}
+		q[k] = v
+	}
+	u.Path = "/" + local
+	u.RawPath = ""
+	u.RawQuery = q.Encode()
+	return true
+}
+
+func (self *wireFormat) setRequestHeaders(req *http.Request, has_body bool) {
+	if !self.enable {
+		return
+	}
+	for k, v := range self.headers {
+		req.Header[k] = v
+	}
+	if has_body {
+		req.Header.Set("Content-Type", self.requestContentType)
+	}
+}
+
+func (self *wireFormat) setResponseHeaders(h http.Header) {
+	if !self.enable {
+		return
+	}
+	h.Set("Content-Type", self.responseContentType)
+	h.Set("Cache-Control", "private, no-store")
+}
+
+// Status of requests to unknown paths, an obfuscated server looks like an ordinary web server
+func (self *wireFormat) unknownPathStatus() int {
+	if self.enable {
+		return http.StatusNotFound
+	}
+	return http.StatusBadGateway
+}
+
+// Data is returned as is while obfuscation is disabled, otherwise framed and padded,
+// an empty data still gets a padding frame so empty polls are not empty bodies
+func (self *wireFormat) encodeBody(data []byte) []byte {
+	if !self.enable {
+		return data
+	}
+	return self.encodeFrames(data)
+}
+
+// Always framed, the padding frame is only added while obfuscation is enabled
+func (self *wireFormat) encodeFrames(data []byte) []byte {
+	var padding []byte
+	if self.enable {
+		padding = make([]byte, self.paddingSize())
+		rand.Read(padding)
+	}
+	body := make([]byte, 0, len(data)+len(padding)+(len(data)/wireFrameMaxPayload+2)*wireFrameHeaderSize)
+	for len(data) > 0 {
+		n := len(data)
+		if n > wireFrameMaxPayload {
+			n = wireFrameMaxPayload
+		}
+		body = appendWireFrame(body, wireFrameData, data[:n])
+		data = data[n:]
+	}
+	if padding != nil {
+		body = appendWireFrame(body, wireFramePadding, padding)
+	}
+	return body
+}
+
+func (self *wireFormat) paddingSize() int {
+	n, err := rand.Int(rand.Reader, big.NewInt(self.paddingMax))
+	if err != nil {
+		return int(self.paddingMax)
+	}
+	return int(n.Int64()) + 1
+}
+
+func appendWireFrame(body []byte, frame_type byte, payload []byte) []byte {
+	body = append(body, frame_type, 0, 0)
+	binary.BigEndian.PutUint16(body[len(body)-2:], uint16(len(payload)))
+	return append(body, payload...)
+}
+
+// Reads the data frames of a body, padding frames are dropped
+func (self *wireFormat) newBodyReader(r io.Reader) io.Reader {
+	if !self.enable {
+		return r
+	}
+	return &wireBodyReader{r: r}
+}
+
+func (self *wireBodyReader) Read(p []byte) (n int, err error) {
+	for self.remain == 0 {
+		if _, err = io.ReadFull(self.r, self.header[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = fmt.Errorf("truncated wire frame header")
+			}
+			return n, err
+		}
+		size := int(binary.BigEndian.Uint16(self.header[1:]))
+		switch self.header[0] {
+		case wireFrameData:
+			self.remain = size
+		case wireFramePadding:
+			if _, err = io.CopyN(io.Discard, self.r, int64(size)); err != nil {
+				return n, fmt.Errorf("truncated wire padding frame, err=[%v]", err)
+			}
+		default:
+			return n, fmt.Errorf("invalid wire frame type, type=%d", self.header[0])
+		}
+	}
+	if len(p) > self.remain {
+		p = p[:self.remain]
+	}
+	n, err = self.r.Read(p)
+	self.remain -= n
+	if err == io.EOF && self.remain > 0 {
+		err = fmt.Errorf("truncated wire data frame")
+	}
+	return n, err
+}
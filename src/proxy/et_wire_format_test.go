@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"bytes"
+	"common"
+	"io"
+	"net/url"
+	"testing"
+)
+
+var wireQueryKeys = []string{
+	QK_CONN_KEY, QK_ADDR, QK_SEQ, QK_HANDSHAKE, QK_AUTH_ID, QK_TIMESTAMP, QK_SIGNATURE, QK_MUX,
+	QK_ACK, QK_TRANSPORT, QK_PAYLOAD, QK_COMPRESS, QK_FILTERS, QK_VERSION, QK_MAX_BLOCK, QK_REVERSE,
+}
+
+// The obfuscation settings are read from the global config, the test ones are restored once the test ends
+func newTestWireFormat(t *testing.T, set func()) (*wireFormat, error) {
+	saved := common.G.Basic.Obfuscation
+	t.Cleanup(func() {
+		common.G.Basic.Obfuscation = saved
+	})
+	common.G.Basic.Obfuscation.Enable = true
+	if set != nil {
+		set()
+	}
+	return newWireFormat()
+}
+
+func TestWireFormatURLRoundTrip(t *testing.T) {
+	cases := []struct {
+		name  string
+		set   func()
+		path  string
+		wire  string
+		param string
+	}{
+		{"default names", nil, QP_DATA, DefaultObfsDataPath, "callback"},
+		{"connect path", nil, QP_CONNECT, DefaultObfsConnectPath, "callback"},
+		{"configured names", func() {
+			common.G.Basic.Obfuscation.DataPath = "/upload/"
+			common.G.Basic.Obfuscation.ParamReverse = "next"
+		}, QP_DATA, "/upload", "next"},
+	}
+	for _, c := range cases {
+		wf, err := newTestWireFormat(t, c.set)
+		if err != nil {
+			t.Fatalf("%s: newWireFormat fail, err=[%v]", c.name, err)
+		}
+		q := url.Values{}
+		for i, k := range wireQueryKeys {
+			q.Set(k, string(rune('A'+i)))
+		}
+		u := &url.URL{Scheme: "http", Host: "h", Path: c.path, RawQuery: q.Encode()}
+		wf.encodeURL(u)
+		if u.Path != c.wire {
+			t.Fatalf("%s: path=[%s] want=[%s]", c.name, u.Path, c.wire)
+		}
+		if u.Query().Get(c.param) != q.Get(QK_REVERSE) {
+			t.Fatalf("%s: reverse param not renamed to [%s], query=[%s]", c.name, c.param, u.RawQuery)
+		}
+		for k := range u.Query() {
+			if _, exist := wf.localParams[k]; !exist {
+				t.Fatalf("%s: param [%s] left unrenamed, query=[%s]", c.name, k, u.RawQuery)
+			}
+		}
+
+		decoded, _ := url.Parse(u.String())
+		if !wf.decodeURL(decoded) {
+			t.Fatalf("%s: path of encoded url unknown, url=[%s]", c.name, u.String())
+		}
+		if decoded.Path != "/"+c.path || decoded.RawQuery != q.Encode() {
+			t.Fatalf("%s: decoded path=[%s] query=[%s] want path=[/%s] query=[%s]", c.name, decoded.Path, decoded.RawQuery, c.path, q.Encode())
+		}
+	}
+}
+
+func TestWireFormatInvalidNames(t *testing.T) {
+	cases := []struct {
+		name string
+		set  func()
+	}{
+		{"duplicate param", func() { common.G.Basic.Obfuscation.ParamSeq = "sid" }},
+		{"reverse param taken", func() { common.G.Basic.Obfuscation.ParamReverse = "n" }},
+		{"duplicate path", func() { common.G.Basic.Obfuscation.DataPath = DefaultObfsConnectPath }},
+		{"root path", func() { common.G.Basic.Obfuscation.ConnectPath = "/" }},
+		{"header without colon", func() { common.G.Basic.Obfuscation.Headers = []string{"X-Test"} }},
+	}
+	for _, c := range cases {
+		if _, err := newTestWireFormat(t, c.set); err == nil {
+			t.Fatalf("%s: invalid obfuscation accepted", c.name)
+		}
+	}
+}
+
+func TestWireFormatDecodeUnknownPath(t *testing.T) {
+	wf, err := newTestWireFormat(t, nil)
+	if err != nil {
+		t.Fatalf("newWireFormat fail, err=[%v]", err)
+	}
+	for _, path := range []string{"/", "/" + QP_DATA, "/api/v1", "/favicon.ico"} {
+		if wf.decodeURL(&url.URL{Path: path}) {
+			t.Fatalf("path=[%s] taken as a tunnel path", path)
+		}
+	}
+}
+
+func TestWireFormatBodyRoundTrip(t *testing.T) {
+	wf, err := newTestWireFormat(t, nil)
+	if err != nil {
+		t.Fatalf("newWireFormat fail, err=[%v]", err)
+	}
+	for _, size := range []int{0, 1, wireFrameMaxPayload, wireFrameMaxPayload + 1, 2*wireFrameMaxPayload + 5} {
+		data := bytes.Repeat([]byte{0x5a}, size)
+		body := wf.encodeBody(data)
+		if len(body) <= size {
+			t.Fatalf("size=%d body=%d carries no framing or padding", size, len(body))
+		}
+		read, err := io.ReadAll(wf.newBodyReader(bytes.NewReader(body)))
+		if err != nil || !bytes.Equal(read, data) {
+			t.Fatalf("size=%d read=%d err=[%v]", size, len(read), err)
+		}
+	}
+}
+
+func TestWireFormatBodyInvalid(t *testing.T) {
+	wf, err := newTestWireFormat(t, nil)
+	if err != nil {
+		t.Fatalf("newWireFormat fail, err=[%v]", err)
+	}
+	cases := []struct {
+		name string
+		body []byte
+	}{
+		{"truncated header", []byte{wireFrameData, 0}},
+		{"truncated data", appendWireFrame(nil, wireFrameData, []byte("data"))[:5]},
+		{"truncated padding", appendWireFrame(nil, wireFramePadding, []byte("pad"))[:4]},
+		{"unknown frame type", appendWireFrame(nil, 9, []byte("data"))},
+	}
+	for _, c := range cases {
+		if _, err := io.ReadAll(wf.newBodyReader(bytes.NewReader(c.body))); err == nil {
+			t.Fatalf("%s: invalid body read", c.name)
+		}
+	}
+}
+
+func TestWireFormatDisabled(t *testing.T) {
+	wf, err := newTestWireFormat(t, func() { common.G.Basic.Obfuscation.Enable = false })
+	if err != nil {
+		t.Fatalf("newWireFormat fail, err=[%v]", err)
+	}
+	u := &url.URL{Path: QP_DATA, RawQuery: QK_REVERSE + "=x"}
+	wf.encodeURL(u)
+	if u.Path != QP_DATA || u.RawQuery != QK_REVERSE+"=x" {
+		t.Fatalf("url renamed while disabled, url=[%s]", u.String())
+	}
+	if body := wf.encodeBody([]byte("data")); string(body) != "data" {
+		t.Fatalf("body framed while disabled, body=[%q]", body)
+	}
+}